@@ -19,6 +19,7 @@ func writeToOutPool(outgoingToPoolChannel chan metricMessage, update metricMessa
 			outgoingToPoolChannel <- update
 		} else {
 			counterData[DroppedOutPool]++
+			recordDroppedMessage(DroppedOutPool, update)
 		}
 
 		// If number of overflows of the "out pool" exceeds threshold, stop blocking and discard data
@@ -41,6 +42,7 @@ func writeIncomingMessage(incomingMessageChannel chan metricMessage, update metr
 			incomingMessageChannel <- update
 		} else {
 			counterData[DroppedIncomingMessages]++
+			recordDroppedMessage(DroppedIncomingMessages, update)
 		}
 	}
 }
@@ -56,6 +58,7 @@ func writeToOutConnection(outgoingToPoolChannel chan metricMessage, update metri
 			outgoingToPoolChannel <- update
 		} else {
 			counterData[DroppedOutConnection]++
+			recordDroppedMessage(DroppedOutConnection, update)
 		}
 	}
 }
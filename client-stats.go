@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Enums for per-client counters
+type ClientCounterId int
+
+const (
+	ClientReceivedMessage ClientCounterId = iota
+	ClientInvalidMessage
+	ClientDiscardedChattyMessage
+	ClientDiscardedStaleMessage
+	ClientSentMessage
+)
+
+var clientCounterNames = []string{
+	`receivedMessage`,
+	`invalidMessage`,
+	`discardedChattyMessage`,
+	`discardedStaleMessage`,
+	`sentMessage`,
+}
+
+// Dots and colons in addresses would otherwise add path components
+var clientDisallowedCharacters = regexp.MustCompile(`[^a-zA-Z0-9_\-]`)
+
+// clientStatistics counts messages per client between two stats generations, after which the counts start over.
+// This keeps the number of tracked clients down to the ones that have sent anything recently.
+type clientStatistics struct {
+	mutex    sync.Mutex
+	counters map[string]*[ClientSentMessage + 1]int64
+	hostname string
+}
+
+var clientStats = clientStatistics{counters: make(map[string]*[ClientSentMessage + 1]int64)}
+
+func initializeClientStats() {
+	if *clientStatsTop <= 0 {
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+		return
+	}
+	clientStats.hostname = hostname
+}
+
+// clientName identifies the sender of a message by its TLS client certificate subject, or else by its IP address.
+// Messages without an origin, like the internal metrics, have no client.
+func clientName(origin messageOrigin) string {
+	if origin.client != "" {
+		return clientDisallowedCharacters.ReplaceAllString(origin.client, "_")
+	}
+	if origin.source == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(origin.source)
+	if err != nil {
+		host = origin.source
+	}
+	return clientDisallowedCharacters.ReplaceAllString(host, "_")
+}
+
+func countClientMessage(origin messageOrigin, counter ClientCounterId) {
+	if *clientStatsTop <= 0 {
+		return
+	}
+	name := clientName(origin)
+	if name == "" {
+		return
+	}
+	clientStats.mutex.Lock()
+	defer clientStats.mutex.Unlock()
+	counters, found := clientStats.counters[name]
+	if !found {
+		counters = new([ClientSentMessage + 1]int64)
+		clientStats.counters[name] = counters
+	}
+	counters[counter]++
+}
+
+// countClientInvalidMessage counts a rejected message as both received and invalid, just like the global counters do
+func countClientInvalidMessage(origin messageOrigin) {
+	countClientMessage(origin, ClientReceivedMessage)
+	countClientMessage(origin, ClientInvalidMessage)
+}
+
+// generateClientStats sends the counters of the clients that sent the most messages since the last time
+func generateClientStats(incomingMessageChannel chan metricMessage) {
+	if *clientStatsTop <= 0 {
+		return
+	}
+	clientStats.mutex.Lock()
+	counters := clientStats.counters
+	clientStats.counters = make(map[string]*[ClientSentMessage + 1]int64)
+	clientStats.mutex.Unlock()
+
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counters[names[i]][ClientReceivedMessage] != counters[names[j]][ClientReceivedMessage] {
+			return counters[names[i]][ClientReceivedMessage] > counters[names[j]][ClientReceivedMessage]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > *clientStatsTop {
+		names = names[:*clientStatsTop]
+	}
+
+	timeStamp := time.Now().Unix()
+	for _, name := range names {
+		for key, value := range counters[name] {
+			var metricPath string
+			if *clientMetricPath == "" {
+				// The counters of the clients are under clients.<client> among the other internal metrics
+				metricPath = renderTemplate(*internalMetricPath, TemplateData{Host: clientStats.hostname, Metric: "clients." + name + "." + clientCounterNames[key], Client: name})
+			} else {
+				metricPath = renderTemplate(*clientMetricPath, TemplateData{Host: clientStats.hostname, Metric: clientCounterNames[key], Client: name})
+			}
+			writeIncomingMessage(incomingMessageChannel, metricMessage{metricPath: metricPath, value: float64(value), timestamp: timeStamp})
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone   = "none"
+	CompressionAuto   = "auto"
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy" // The snappy framing format, as written by for example python-snappy's StreamCompressor
+	CompressionZstd   = "zstd"
+
+	ZstdMaxWindowSize = 1 << 25 // Limits the memory a single connection may make the zstd decoder allocate
+)
+
+// Magic bytes at the start of each compressed stream format, used by CompressionAuto
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// listenerOptions are given after the listening address, like "2003,compression=auto,profile=infrastructure"
+type listenerOptions struct {
+	compression string
+	profile     *policyProfile
+}
+
+// parseListenerOptions splits a listening address from its options
+func parseListenerOptions(listenAddress string, profiles map[string]*policyProfile) (string, listenerOptions, error) {
+	fields := strings.Split(listenAddress, ",")
+	options := listenerOptions{compression: CompressionNone, profile: profiles[DefaultProfileName]}
+	for _, option := range fields[1:] {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return "", options, errors.New("Invalid listener option \"" + option + "\" in " + listenAddress)
+		}
+		switch keyValue[0] {
+		case "compression":
+			switch keyValue[1] {
+			case CompressionNone, CompressionAuto, CompressionGzip, CompressionSnappy, CompressionZstd:
+				options.compression = keyValue[1]
+			default:
+				return "", options, errors.New("Invalid compression \"" + keyValue[1] + "\" in " + listenAddress)
+			}
+		case "profile":
+			profile, ok := profiles[keyValue[1]]
+			if !ok {
+				return "", options, errors.New("Unknown profile \"" + keyValue[1] + "\" in " + listenAddress)
+			}
+			options.profile = profile
+		default:
+			return "", options, errors.New("Unknown listener option \"" + keyValue[0] + "\" in " + listenAddress)
+		}
+	}
+	return fields[0], options, nil
+}
+
+// parseProfileListenerOptions is parseListenerOptions for the listeners that don't read plaintext streams, which only
+// accept the profile option
+func parseProfileListenerOptions(listenAddress string, profiles map[string]*policyProfile) (string, *policyProfile, error) {
+	address, options, err := parseListenerOptions(listenAddress, profiles)
+	if err == nil && options.compression != CompressionNone {
+		err = errors.New("Compression is only supported on plaintext TCP listeners: " + listenAddress)
+	}
+	return address, options.profile, err
+}
+
+// detectCompression looks at the first bytes of a stream. Plaintext graphite never starts with any of the magic
+// bytes, so only as many bytes as needed to tell the formats apart are waited for.
+func detectCompression(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	for _, format := range []struct {
+		compression string
+		magic       []byte
+	}{{CompressionGzip, gzipMagic}, {CompressionSnappy, snappyMagic}, {CompressionZstd, zstdMagic}} {
+		if first[0] != format.magic[0] {
+			continue
+		}
+		if magic, err := reader.Peek(len(format.magic)); err == nil && bytes.Equal(magic, format.magic) {
+			return format.compression, nil
+		}
+	}
+	return CompressionNone, nil
+}
+
+// newDecompressingReader returns a reader for the decompressed stream, which is closed when the connection is done
+func newDecompressingReader(reader *bufio.Reader, compression string) (io.ReadCloser, error) {
+	if compression == CompressionAuto {
+		var err error
+		if compression, err = detectCompression(reader); err != nil {
+			return nil, err
+		}
+	}
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(reader)
+	case CompressionSnappy:
+		return io.NopCloser(snappy.NewReader(reader)), nil
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(reader, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(ZstdMaxWindowSize))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(reader), nil
+}
+
+// isDecompressionError tells corrupt or truncated compressed streams apart from closed connections and network errors
+func isDecompressionError(err error) bool {
+	var networkError net.Error
+	return err != nil && err != io.EOF && !errors.As(err, &networkError)
+}
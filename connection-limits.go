@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var errLineTooLong = errors.New("Line exceeds maximum line length")
+
+// connectionLimiter keeps track of the concurrent incoming connections, in total and per source IP address
+type connectionLimiter struct {
+	mutex       sync.Mutex
+	connections int
+	perSource   map[string]int
+}
+
+var incomingConnectionLimiter = connectionLimiter{perSource: make(map[string]int)}
+
+// acquire reserves a connection slot for the source of the connection, unless a limit has been reached
+func (limiter *connectionLimiter) acquire(source string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if *maxConnections > 0 && limiter.connections >= *maxConnections {
+		counterData[ClientConnectionLimitReached]++
+		return false
+	}
+	if *maxConnectionsPerSource > 0 && limiter.perSource[source] >= *maxConnectionsPerSource {
+		counterData[ClientConnectionSourceLimitReached]++
+		return false
+	}
+	limiter.connections++
+	limiter.perSource[source]++
+	return true
+}
+
+func (limiter *connectionLimiter) release(source string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.connections--
+	if limiter.perSource[source]--; limiter.perSource[source] <= 0 {
+		delete(limiter.perSource, source)
+	}
+}
+
+// connectionSourceIp returns the IP address of the client, which with -proxyprotocol is the address from
+// the PROXY protocol header. All unix socket clients share the same empty source.
+func connectionSourceIp(connection net.Conn) string {
+	host, _, err := net.SplitHostPort(connection.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// handleLimitedConnection enforces the connection limits and the idle timeout before the first read, which
+// also covers the PROXY protocol header and TLS handshake, and then hands the connection over to its handler
+func handleLimitedConnection(connection net.Conn, incomingMessageChannel chan metricMessage, connectionHandler func(net.Conn, chan metricMessage)) {
+	if *idleTimeout > 0 {
+		connection.SetReadDeadline(time.Now().Add(time.Duration(*idleTimeout) * time.Second))
+	}
+	source := connectionSourceIp(connection)
+	if !incomingConnectionLimiter.acquire(source) {
+		connection.Close()
+		return
+	}
+	defer incomingConnectionLimiter.release(source)
+	connectionHandler(connection, incomingMessageChannel)
+}
+
+// limitingListener applies the connection limits to the HTTP listener, whose connections are handled by net/http
+type limitingListener struct {
+	net.Listener
+}
+
+func (listener limitingListener) Accept() (net.Conn, error) {
+	connection, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: connection}, nil
+}
+
+// limitedConn reserves a connection slot on first use, rather than in Accept, since the source address may have to be
+// read from a PROXY protocol header. Connections over a limit read as if the client had closed them, so that net/http
+// closes them without a reply.
+type limitedConn struct {
+	net.Conn
+	acquireOnce sync.Once
+	releaseOnce sync.Once
+	source      string
+	acquired    bool
+}
+
+func (connection *limitedConn) acquire() {
+	connection.acquireOnce.Do(func() {
+		connection.source = connectionSourceIp(connection.Conn)
+		connection.acquired = incomingConnectionLimiter.acquire(connection.source)
+	})
+}
+
+func (connection *limitedConn) Read(buffer []byte) (int, error) {
+	if connection.acquire(); !connection.acquired {
+		return 0, io.EOF
+	}
+	return connection.Conn.Read(buffer)
+}
+
+func (connection *limitedConn) Close() error {
+	// Once closed, a connection that was never read from can't reserve a slot anymore
+	connection.acquireOnce.Do(func() {})
+	connection.releaseOnce.Do(func() {
+		if connection.acquired {
+			incomingConnectionLimiter.release(connection.source)
+		}
+	})
+	return connection.Conn.Close()
+}
+
+// waitForNextMessage waits at most -idletimeout seconds for the next message to begin, and then allows
+// -readtimeout seconds for the rest of it to arrive
+func waitForNextMessage(connection net.Conn, reader *bufio.Reader) error {
+	if *idleTimeout > 0 {
+		connection.SetReadDeadline(time.Now().Add(time.Duration(*idleTimeout) * time.Second))
+	}
+	if _, err := reader.Peek(1); err != nil {
+		countTimeout(err, ClientConnectionIdleTimeout)
+		return err
+	}
+	if *readTimeout > 0 {
+		connection.SetReadDeadline(time.Now().Add(time.Duration(*readTimeout) * time.Second))
+	} else if *idleTimeout > 0 {
+		connection.SetReadDeadline(time.Time{})
+	}
+	return nil
+}
+
+// readLimitedLine reads the next line, waiting at most -idletimeout seconds for it to begin and -readtimeout seconds
+// for the rest of it to arrive. Lines longer than -maxlinelength are read to their end and discarded, returning errLineTooLong.
+func readLimitedLine(connection net.Conn, reader *bufio.Reader) (string, error) {
+	if err := waitForNextMessage(connection, reader); err != nil {
+		return "", err
+	}
+
+	var line []byte
+	tooLong := false
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if *maxLineLength > 0 && len(line)+len(fragment) > *maxLineLength {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, fragment...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			countTimeout(err, ClientConnectionReadTimeout)
+			return string(line), err
+		}
+		if tooLong {
+			counterData[OversizedLine]++
+			return "", errLineTooLong
+		}
+		return string(line), nil
+	}
+}
+
+func countTimeout(err error, counter CounterId) {
+	var networkError net.Error
+	if errors.As(err, &networkError) && networkError.Timeout() {
+		counterData[counter]++
+	}
+}
@@ -2,48 +2,129 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-func handleIncomingConnection(connection net.Conn, incomingMessageChannel chan metricMessage) {
+// handleIncomingConnection reads plaintext graphite lines, after decompressing the stream if the listener is configured to
+func (options listenerOptions) handleIncomingConnection(connection net.Conn, incomingMessageChannel chan metricMessage) {
 	defer connection.Close()
-	reader := bufio.NewReader(connection)
+	client, err := connectionClientIdentity(connection)
+	if err != nil {
+		return
+	}
+	origin := messageOrigin{source: connection.RemoteAddr().String(), client: client, profile: options.profile}
 	counterData[ClientConnectionOpening]++
 	gaugeData[ClientConnectionsActive]++
-	for {
-		netData, err := reader.ReadString('\n')
-		if err != nil {
-			break // Break out of for loop and close connection
-		}
-
-		// Parse incoming message and forward it, if the message format is valid
-		incomingMessage, err := parseGraphiteMessage(strings.TrimSpace(string(netData)))
-		counterData[ReceivedMessage]++
+	decompressedStream, err := newDecompressingReader(bufio.NewReader(connection), options.compression)
+	if err == nil {
+		defer decompressedStream.Close()
+		reader := bufio.NewReader(decompressedStream)
+		for {
+			var netData string
+			netData, err = readLimitedLine(connection, reader)
+			if err == errLineTooLong {
+				continue
+			}
+			if err != nil {
+				break // Break out of for loop and close connection
+			}
 
-		if err != nil {
-			counterData[InvalidMessage]++
-		} else {
-			writeIncomingMessage(incomingMessageChannel, incomingMessage)
+			processIncomingLine(netData, origin, incomingMessageChannel)
 		}
 	}
+	if isDecompressionError(err) {
+		counterData[DecompressionError]++
+	}
 	counterData[ClientConnectionClosing]++
 	gaugeData[ClientConnectionsActive]--
 }
 
-func createIncomingConnections(incomingPort string, incomingMessageChannel chan metricMessage) {
-	listen, err := net.Listen("tcp4", ":"+incomingPort)
+// processIncomingLine parses a single plaintext graphite line and forwards it, if the message format is valid.
+// Invalid lines are recorded in the dead-letter sink, if there is one.
+func processIncomingLine(line string, origin messageOrigin, incomingMessageChannel chan metricMessage) error {
+	incomingMessage, err := parseGraphiteMessage(strings.TrimSpace(line))
+	incomingMessage.messageOrigin = origin
+	counterData[ReceivedMessage]++
+
+	if err != nil {
+		recordDeadLetter(countInvalidMessage(err), origin, strings.TrimRight(line, "\r\n"))
+		countClientInvalidMessage(origin)
+	} else {
+		writeIncomingMessage(incomingMessageChannel, incomingMessage)
+	}
+	return err
+}
+
+// parseListenAddress translates a listen address to a network and address for net.Listen. Examples of valid listen addresses:
+// * 2003 (all interfaces, dual-stack where the OS supports it)
+// * :2003 (same as above)
+// * 10.0.0.5:2003
+// * [::]:2003 (dual-stack)
+// * [2001:db8::5]:2003
+// * tcp4::2003 or tcp6:[::]:2003 (only IPv4 or IPv6)
+// * unix:/run/hadrianus.sock
+func parseListenAddress(listenAddress string, network string) (string, string) {
+	if strings.HasPrefix(listenAddress, "unix:") {
+		if network == "udp" {
+			return "unixgram", strings.TrimPrefix(listenAddress, "unix:")
+		}
+		return "unix", strings.TrimPrefix(listenAddress, "unix:")
+	}
+	for _, family := range []string{"4", "6"} {
+		if strings.HasPrefix(listenAddress, "tcp"+family+":") {
+			listenAddress = strings.TrimPrefix(listenAddress, "tcp"+family+":")
+			network += family
+			break
+		}
+	}
+	if _, err := strconv.ParseUint(listenAddress, 10, 16); err == nil {
+		listenAddress = ":" + listenAddress
+	}
+	return network, listenAddress
+}
+
+// removeStaleUnixSocket removes a socket file left behind by an earlier process, so that it can be listened on again
+func removeStaleUnixSocket(network string, address string) {
+	if network != "unix" && network != "unixgram" {
+		return
+	}
+	if fileInfo, err := os.Stat(address); err == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+		os.Remove(address)
+	}
+}
+
+func createListener(listenAddress string) net.Listener {
+	network, address := parseListenAddress(listenAddress, "tcp")
+	removeStaleUnixSocket(network, address)
+	listen, err := net.Listen(network, address)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
-		return
 	}
+	if *proxyProtocol {
+		return proxyProtocolListener{listen}
+	}
+	return listen
+}
+
+// createIncomingTlsConnections terminates TLS and then handles connections just like createIncomingConnections
+func createIncomingTlsConnections(listenAddress string, tlsConfig *tls.Config, incomingMessageChannel chan metricMessage, connectionHandler func(net.Conn, chan metricMessage)) {
+	listen := tls.NewListener(createListener(listenAddress), tlsConfig)
 	defer listen.Close()
 
 	for {
@@ -53,60 +134,324 @@ func createIncomingConnections(incomingPort string, incomingMessageChannel chan
 			log.Println(err)
 			os.Exit(1)
 		}
-		go handleIncomingConnection(connection, incomingMessageChannel)
+		go handleLimitedConnection(connection, incomingMessageChannel, connectionHandler)
 	}
 }
 
-func createOutgoingConnection(outgoingHostPort string, outgoingMessageChannel chan metricMessage) {
+func createIncomingConnections(listenAddress string, incomingMessageChannel chan metricMessage, connectionHandler func(net.Conn, chan metricMessage)) {
+	listen := createListener(listenAddress)
+	defer listen.Close()
+
 	for {
-		addr, _ := net.ResolveTCPAddr("tcp", outgoingHostPort)
-		connection, err := net.DialTCP("tcp", nil, addr)
-		err2 := connection.SetNoDelay(TcpNoDelay)
-		if err2 != nil {
-			log.Println("Attempt to set \"NoDelay\" failed:", err.Error())
+		connection, err := listen.Accept()
+
+		if err != nil {
+			log.Println(err)
 			os.Exit(1)
 		}
+		go handleLimitedConnection(connection, incomingMessageChannel, connectionHandler)
+	}
+}
 
+// Counters that are kept separately for each kind of datagram listener
+type datagramCounters struct {
+	received  CounterId
+	truncated CounterId
+	readError CounterId
+}
+
+// createIncomingUdpListener reads newline delimited lines from datagrams and passes each of them to lineHandler,
+// along with the address of the sender
+func createIncomingUdpListener(listenAddress string, counters datagramCounters, lineHandler func(string, string)) {
+	network, address := parseListenAddress(listenAddress, "udp")
+	removeStaleUnixSocket(network, address)
+	packetConnection, err := net.ListenPacket(network, address)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+		return
+	}
+	defer packetConnection.Close()
+
+	// Both UDP and unix datagram sockets report truncation in the message flags
+	readMessage := func(buffer []byte) (int, int, string, error) {
+		if unixConnection, ok := packetConnection.(*net.UnixConn); ok {
+			length, _, flags, address, err := unixConnection.ReadMsgUnix(buffer, nil)
+			if address == nil {
+				return length, flags, "", err
+			}
+			return length, flags, address.String(), err
+		}
+		length, _, flags, address, err := packetConnection.(*net.UDPConn).ReadMsgUDP(buffer, nil)
+		if address == nil {
+			return length, flags, "", err
+		}
+		return length, flags, address.String(), err
+	}
+
+	buffer := make([]byte, *udpReadBufferSize)
+	for {
+		length, flags, source, err := readMessage(buffer)
 		if err != nil {
-			log.Println("Failed to connect to", outgoingHostPort+":", err.Error())
-			os.Exit(1)
+			counterData[counters.readError]++
+			continue
+		}
+		counterData[counters.received]++
+		datagram := buffer[:length]
+
+		// The tail of a truncated datagram is an incomplete line, so only keep the complete lines
+		if flags&syscall.MSG_TRUNC != 0 || length >= len(buffer) {
+			counterData[counters.truncated]++
+			lastNewline := bytes.LastIndexByte(datagram, '\n')
+			if lastNewline < 0 {
+				continue
+			}
+			datagram = datagram[:lastNewline]
+		}
+
+		for _, line := range strings.Split(string(datagram), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			lineHandler(line, source)
+		}
+	}
+}
+
+// dialDestination connects to a destination, and does the TLS handshake if the destination asks for it
+func dialDestination(destination outgoingDestination) (net.Conn, error) {
+	connection, err := net.DialTimeout("tcp", destination.hostPort, DestinationDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if tcpConnection, ok := connection.(*net.TCPConn); ok {
+		if err := tcpConnection.SetNoDelay(TcpNoDelay); err != nil {
+			connection.Close()
+			return nil, err
+		}
+	}
+	if destination.tlsConfig == nil {
+		return connection, nil
+	}
+	tlsConnection := tls.Client(connection, destination.tlsConfig)
+	tlsConnection.SetDeadline(time.Now().Add(DestinationDialTimeout))
+	if err := tlsConnection.Handshake(); err != nil {
+		connection.Close()
+		return nil, err
+	}
+	tlsConnection.SetDeadline(time.Time{})
+	return tlsConnection, nil
+}
+
+var errDestinationClosed = errors.New("Connection closed by destination")
+
+// watchForClose closes the returned channel when the destination closes the connection. Destinations never send
+// anything, so this notices a restarted destination before the next write, which would otherwise be lost.
+func watchForClose(connection net.Conn) chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, connection)
+		close(closed)
+	}()
+	return closed
+}
+
+// writePlaintextMessages writes the unsent messages from the previous connection, if any, and then the messages from
+// the channel until it's closed. If a write fails, the messages that may not have been sent are returned.
+func writePlaintextMessages(connection io.Writer, outgoingMessageChannel chan metricMessage, unsent []metricMessage, closed chan struct{}) ([]metricMessage, error) {
+	for i, outMessage := range unsent {
+		if _, err := fmt.Fprintln(connection, outMessage.metricPath, outMessage.value, outMessage.timestamp); err != nil {
+			return unsent[i:], err
+		}
+	}
+	for {
+		select {
+		case outMessage, ok := <-outgoingMessageChannel:
+			if !ok {
+				return nil, nil
+			}
+			if _, err := fmt.Fprintln(connection, outMessage.metricPath, outMessage.value, outMessage.timestamp); err != nil {
+				return []metricMessage{outMessage}, err
+			}
+		case <-closed:
+			return nil, errDestinationClosed
+		}
+	}
+}
+
+// reconnectDelay is the current backoff interval with jitter, so that hadrianus instances that lost the same
+// destination at the same time don't all reconnect at the same time. It's between half and all of the interval.
+func reconnectDelay(interval time.Duration) time.Duration {
+	return interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+}
+
+// createOutgoingConnection sends the messages for one destination until the channel is closed. When the destination
+// can't be reached, it reconnects with exponential backoff, while messages are kept in the channel or the spool.
+func createOutgoingConnection(destination outgoingDestination, queue *outgoingQueue) {
+	outgoingHostPort := destination.hostPort
+	minimumInterval := time.Duration(*reconnectInterval) * time.Millisecond
+	maximumInterval := time.Duration(*reconnectMaxInterval) * time.Millisecond
+	interval := minimumInterval
+	isDown := false
+	var unsent []metricMessage
+	for {
+		outConnection, err := dialDestination(destination)
+		if err != nil {
+			counterData[OutConnectionFailed]++
+			// Only log when the destination goes down, and not for every failed attempt to reconnect
+			if !isDown {
+				log.Println("Failed to connect to", outgoingHostPort+":", err.Error())
+				isDown = true
+				queue.down.Store(true)
+				gaugeData[OutConnectionsDown]++
+			}
+			time.Sleep(reconnectDelay(interval))
+			interval = min(interval*2, maximumInterval)
+			continue
+		}
+		counterData[OutConnectionOpened]++
+		if isDown {
+			log.Println("Reconnected to", outgoingHostPort)
+			isDown = false
+			queue.down.Store(false)
+			gaugeData[OutConnectionsDown]--
+		}
+		interval = minimumInterval
+
+		closed := watchForClose(outConnection)
+		if destination.protocol == PickleProtocol {
+			unsent, err = writePickleBatches(outConnection, queue.channel, unsent, destination.batchSize, destination.batchLatency, closed)
 		} else {
-			for {
-				outMessage := <-outgoingMessageChannel
-				text := fmt.Sprintln(outMessage.metricPath, outMessage.value, outMessage.timestamp)
-				_, err = connection.Write([]byte(text))
-				if err != nil {
-					log.Println("Write to output to", outgoingHostPort, "failed:", err.Error())
-					os.Exit(1)
-				}
+			unsent, err = writePlaintextMessages(outConnection, queue.channel, unsent, closed)
+		}
+		outConnection.Close()
+		if err == nil {
+			// The channel is only closed at the end of the input, once everything has been written to it
+			return
+		}
+		counterData[OutConnectionLost]++
+		log.Println("Write to output to", outgoingHostPort, "failed:", err.Error())
+		isDown = true
+		queue.down.Store(true)
+		gaugeData[OutConnectionsDown]++
+		time.Sleep(reconnectDelay(interval))
+	}
+}
+
+// outgoingQueue holds the messages for one destination until they have been written to it
+type outgoingQueue struct {
+	channel chan metricMessage
+	down    atomic.Bool // Set while the destination can't be reached
+	spool   *diskSpool  // Only set for destinations with spool=true
+}
+
+func (queue *outgoingQueue) write(message metricMessage) {
+	if queue.spool != nil {
+		queue.spool.write(queue, message)
+		return
+	}
+	writeToOutConnection(queue.channel, message)
+}
+
+// close is called at the end of the input, when nothing more will be written. Spooled messages are replayed first.
+func (queue *outgoingQueue) close() {
+	if queue.spool != nil {
+		queue.spool.waitUntilReplayed()
+	}
+	close(queue.channel)
+}
+
+// failedOver tells if messages for the destination go to the others in its pool. Destinations with a spool keep
+// their messages, since spooling them while the destination is down is the point of having one.
+func (queue *outgoingQueue) failedOver() bool {
+	return queue.spool == nil && queue.down.Load()
+}
+
+// nextRoundRobinDestination returns the next destination in the rotation of a pool, passing over the ones that are
+// down so that the others share their messages evenly. If all of them are down, it returns the next one anyway.
+func nextRoundRobinDestination(queues []*outgoingQueue, next *int, failover bool) int {
+	first := *next
+	for step := 0; step < len(queues); step++ {
+		destination := (first + step) % len(queues)
+		if !failover || !queues[destination].failedOver() {
+			if step > 0 {
+				counterData[ReroutedMessage]++
 			}
+			*next = (destination + 1) % len(queues)
+			return destination
 		}
 	}
+	*next = (first + 1) % len(queues)
+	return first
 }
 
-func handleOutgoingPool(outgoingToPoolChannel chan metricMessage, outgoingHostPort [][]string) {
-	var outgoingMessageChannel [][]chan metricMessage
-	messagesSent := 0
+// handleOutgoingPool distributes messages to the outgoing connections of each pool according to its routing. In pools
+// with failover=true, messages for destinations that are down go to the others in the pool.
+// When outgoingToPoolChannel is closed, outputsDrained is closed once all messages have been written to the destinations.
+func handleOutgoingPool(outgoingToPoolChannel chan metricMessage, outgoingHostPort [][]outgoingDestination, outgoingRouting []poolRouting, outputsDrained chan struct{}) {
+	var outgoingQueues [][]*outgoingQueue
+	var outgoingConnections sync.WaitGroup
 	numberOfPools := len(outgoingHostPort)
 	var numberOutConnections []int
 	for currentPool := 0; currentPool < numberOfPools; currentPool++ {
 		numberOutConnections = append(numberOutConnections, len(outgoingHostPort[currentPool]))
 		// Create pool of outgoing connections
-		var emptySlice []chan metricMessage
-		outgoingMessageChannel = append(outgoingMessageChannel, emptySlice)
+		var emptySlice []*outgoingQueue
+		outgoingQueues = append(outgoingQueues, emptySlice)
 		for connectionInPool := 0; connectionInPool < numberOutConnections[currentPool]; connectionInPool++ {
-			outgoingMessageChannel[currentPool] = append(outgoingMessageChannel[currentPool], make(chan metricMessage, OutgoingChannelSize))
-			go createOutgoingConnection(outgoingHostPort[currentPool][connectionInPool], outgoingMessageChannel[currentPool][connectionInPool])
+			destination := outgoingHostPort[currentPool][connectionInPool]
+			queue := &outgoingQueue{channel: make(chan metricMessage, OutgoingChannelSize)}
+			if destination.spool {
+				spool, err := newDiskSpool(spoolDirectoryName(currentPool, destination))
+				if err != nil {
+					log.Println(err)
+					os.Exit(1)
+					return
+				}
+				queue.spool = spool
+				go spool.replay(queue, *spoolReplayRate)
+			}
+			outgoingQueues[currentPool] = append(outgoingQueues[currentPool], queue)
+			outgoingConnections.Add(1)
+			go func(destination outgoingDestination, queue *outgoingQueue) {
+				defer outgoingConnections.Done()
+				createOutgoingConnection(destination, queue)
+			}(destination, queue)
 		}
 	}
 
-	for {
-		fromConnection := <-outgoingToPoolChannel
+	// The health of each destination is whether its connection is currently down
+	nextConnection := make([]int, numberOfPools)
+	isDown := make([]func(int) bool, numberOfPools)
+	for currentPool, queues := range outgoingQueues {
+		if outgoingRouting[currentPool].failover {
+			isDown[currentPool] = func(destination int) bool { return queues[destination].failedOver() }
+		}
+	}
+
+	var destinations []int
+	for fromConnection := range outgoingToPoolChannel {
 		for currentPool := 0; currentPool < numberOfPools; currentPool++ {
-			writeToOutConnection(outgoingMessageChannel[currentPool][messagesSent%numberOutConnections[currentPool]], fromConnection)
+			routing := outgoingRouting[currentPool]
+			if routing.hash == nil {
+				destination := nextRoundRobinDestination(outgoingQueues[currentPool], &nextConnection[currentPool], routing.failover)
+				outgoingQueues[currentPool][destination].write(fromConnection)
+				continue
+			}
+			destinations = routing.hash.getDestinations(fromConnection.metricPath, routing.replicas, destinations, isDown[currentPool])
+			for _, destination := range destinations {
+				outgoingQueues[currentPool][destination].write(fromConnection)
+			}
+		}
+	}
+
+	for _, pool := range outgoingQueues {
+		for _, queue := range pool {
+			queue.close()
 		}
-		messagesSent++
 	}
+	outgoingConnections.Wait()
+	close(outputsDrained)
 }
 
 // mungeClusterNodesDestinations processes a list of addresses for cluster nodes, for outputting to several different graphite clusters
@@ -114,37 +459,51 @@ func handleOutgoingPool(outgoingToPoolChannel chan metricMessage, outgoingHostPo
 // * 1234 (translates to 127.0.0.1:1234)
 // * :4565 (translates to 127.0.0.1:4565)
 // * 23.41.31.1:4565
+// * [2001:db8::1]:4565
 // * sillyhostname23.sillyhostnamesrus.com:4565
-func mungeClusterNodesDestinations(outgoingDestination []string) error {
-	hostPortPattern := regexp.MustCompile(`^(?:([a-z0-9][a-z0-9.-]*)?:)?(\d+)$`)
-	for outgoingIndex, outNode := range outgoingDestination {
-		nodePatternCapture := hostPortPattern.FindStringSubmatch(strings.ToLower(outNode))
+// * sillyhostname23.sillyhostnamesrus.com:2004,protocol=pickle,batchsize=1000
+// * sillyhostname23.sillyhostnamesrus.com:2013,tls=true,ca=/etc/ssl/relay-ca.pem
+func mungeClusterNodesDestinations(outgoingNodes []string) ([]outgoingDestination, error) {
+	hostPortPattern := regexp.MustCompile(`^(?:(?:\[([0-9a-f:.]+(?:%[a-z0-9_.-]+)?)\]|([a-z0-9][a-z0-9.-]*))?:)?(\d+)$`)
+	var destinations []outgoingDestination
+	for _, outNode := range outgoingNodes {
+		nodeFields := strings.Split(outNode, ",")
+		nodePatternCapture := hostPortPattern.FindStringSubmatch(strings.ToLower(nodeFields[0]))
 
 		if nodePatternCapture != nil {
 			var hostname string
-			if nodePatternCapture[1] == "" { // A blank hostname will imply the local host
+			if nodePatternCapture[1] != "" { // IPv6 literal within brackets
+				if net.ParseIP(strings.SplitN(nodePatternCapture[1], "%", 2)[0]) == nil {
+					return nil, errors.New("Invalid IPv6 address: \"" + nodePatternCapture[1] + "\"")
+				}
+				hostname = nodePatternCapture[1]
+			} else if nodePatternCapture[2] == "" { // A blank hostname will imply the local host
 				hostname = "127.0.0.1"
 			} else {
-				hostname = nodePatternCapture[1]
+				hostname = nodePatternCapture[2]
 			}
 
 			// Verify that TCP port is within a valid interval
-			portNumberInteger, _ := strconv.ParseInt(nodePatternCapture[2], 10, 64)
+			portNumberInteger, _ := strconv.ParseInt(nodePatternCapture[3], 10, 64)
 			var portNumber string
 			if portNumberInteger > 65535 {
-				return errors.New("Port number too big: \"" + nodePatternCapture[2] + "\"")
+				return nil, errors.New("Port number too big: \"" + nodePatternCapture[3] + "\"")
 			}
-			portNumber = nodePatternCapture[2]
+			portNumber = nodePatternCapture[3]
 
 			// Verify that the hostname can be resolved
-			if _, err := net.LookupIP(hostname); err == nil {
-				outgoingDestination[outgoingIndex] = hostname + ":" + portNumber
-			} else {
-				return errors.New("Invalid hostname: \"" + hostname + "\"")
+			if _, err := net.LookupIP(strings.SplitN(hostname, "%", 2)[0]); err != nil {
+				return nil, errors.New("Invalid hostname: \"" + hostname + "\"")
+			}
+
+			destination, err := parseDestinationOptions(net.JoinHostPort(hostname, portNumber), nodeFields[1:])
+			if err != nil {
+				return nil, err
 			}
+			destinations = append(destinations, destination)
 		} else {
-			return errors.New("Invalid host:port supplied: \"" + outNode + "\"")
+			return nil, errors.New("Invalid host:port supplied: \"" + outNode + "\"")
 		}
 	}
-	return nil
+	return destinations, nil
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DeadLetterChannelSize  = 4096
+	DeadLetterDialTimeout  = 5 * time.Second
+	DeadLetterWriteTimeout = 5 * time.Second // A destination that stops reading is reconnected to, rather than blocking the sink
+	DeadLetterRetryDelay   = 5 * time.Second // Dead letters are dropped for this long after the destination failed
+)
+
+// deadLetter is a rejected or dropped message, along with why, where and when it was received
+type deadLetter struct {
+	receiveTime time.Time
+	reason      CounterId
+	source      string
+	line        string
+}
+
+// rejectedMessage is a message that a converter couldn't translate, with the reason it was rejected for
+type rejectedMessage struct {
+	reason CounterId
+	line   string
+}
+
+// Dead letters are written by a single goroutine, so that a slow sink never holds up the listeners.
+// The channel is nil if there is no dead-letter sink.
+var deadLetterChannel chan deadLetter
+
+// Dead letters that have been queued but not yet written or dropped
+var pendingDeadLetters sync.WaitGroup
+
+// recordDeadLetter queues a message for the dead-letter sink, or drops it if the queue is full
+func recordDeadLetter(reason CounterId, origin messageOrigin, line string) {
+	if deadLetterChannel == nil {
+		return
+	}
+	pendingDeadLetters.Add(1)
+	select {
+	case deadLetterChannel <- deadLetter{receiveTime: time.Now(), reason: reason, source: origin.source, line: line}:
+	default:
+		pendingDeadLetters.Done()
+		counterData[DeadLetterDropped]++
+	}
+}
+
+// recordDroppedMessage queues a message that was dropped after it had been accepted, in plaintext format
+func recordDroppedMessage(reason CounterId, message metricMessage) {
+	if deadLetterChannel == nil {
+		return
+	}
+	recordDeadLetter(reason, message.messageOrigin, fmt.Sprint(message.metricPath, " ", message.value, " ", message.timestamp))
+}
+
+func recordRejectedMessages(rejected []rejectedMessage, origin messageOrigin) {
+	for _, message := range rejected {
+		recordDeadLetter(message.reason, origin, message.line)
+	}
+}
+
+// waitForDeadLetters returns once the queued dead letters have been handled, before exiting at the end of the input
+func waitForDeadLetters() {
+	pendingDeadLetters.Wait()
+}
+
+// format writes the dead letter as one tab separated line. The message is quoted, since it may contain anything.
+func (letter deadLetter) format() []byte {
+	record := letter.receiveTime.UTC().AppendFormat(nil, time.RFC3339Nano)
+	record = append(record, '\t')
+	record = append(record, counterNames[letter.reason]...)
+	record = append(record, '\t')
+	if letter.source == "" {
+		record = append(record, '-')
+	} else {
+		record = append(record, letter.source...)
+	}
+	record = append(record, '\t')
+	record = strconv.AppendQuote(record, letter.line)
+	return append(record, '\n')
+}
+
+// deadLetterFile appends to a file, which is rotated to filename.1 when it would grow beyond maxSize
+type deadLetterFile struct {
+	filename string
+	maxSize  int64
+	file     *os.File
+	size     int64
+}
+
+func (sink *deadLetterFile) open() error {
+	file, err := os.OpenFile(sink.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = fileInfo.Size()
+	return nil
+}
+
+func (sink *deadLetterFile) write(record []byte) error {
+	if sink.file != nil && sink.size > 0 && sink.size+int64(len(record)) > sink.maxSize {
+		sink.file.Close()
+		sink.file = nil
+		if err := os.Rename(sink.filename, sink.filename+".1"); err != nil {
+			return err
+		}
+	}
+	if sink.file == nil {
+		if err := sink.open(); err != nil {
+			return err
+		}
+	}
+	length, err := sink.file.Write(record)
+	sink.size += int64(length)
+	return err
+}
+
+var errDeadLetterDestinationDown = errors.New("Dead-letter destination is down")
+
+// deadLetterDestination sends dead letters over TCP, reconnecting when a write fails or times out
+type deadLetterDestination struct {
+	hostPort   string
+	connection net.Conn
+	retryTime  time.Time // No connection is attempted before then, so that queued dead letters are dropped quickly
+}
+
+func (sink *deadLetterDestination) write(record []byte) error {
+	if sink.connection == nil {
+		if time.Now().Before(sink.retryTime) {
+			return errDeadLetterDestinationDown
+		}
+		connection, err := net.DialTimeout("tcp", sink.hostPort, DeadLetterDialTimeout)
+		if err != nil {
+			sink.retryTime = time.Now().Add(DeadLetterRetryDelay)
+			return err
+		}
+		sink.connection = connection
+	}
+	sink.connection.SetWriteDeadline(time.Now().Add(DeadLetterWriteTimeout))
+	if _, err := sink.connection.Write(record); err != nil {
+		sink.connection.Close()
+		sink.connection = nil
+		sink.retryTime = time.Now().Add(DeadLetterRetryDelay)
+		return err
+	}
+	return nil
+}
+
+// writeDeadLetters writes at most maxRate dead letters per second, dropping the rest
+func writeDeadLetters(write func([]byte) error, maxRate int) {
+	var windowStart time.Time
+	writtenInWindow := 0
+	var lastError string
+	for letter := range deadLetterChannel {
+		if now := time.Now(); now.Sub(windowStart) >= time.Second {
+			windowStart = now
+			writtenInWindow = 0
+		}
+		if maxRate > 0 && writtenInWindow >= maxRate {
+			counterData[DeadLetterDropped]++
+		} else if err := write(letter.format()); err != nil {
+			writtenInWindow++
+			counterData[DeadLetterDropped]++
+			// Only log when the error changes, so that a broken sink doesn't flood the log
+			if err.Error() != lastError {
+				log.Println("Failed to write dead letter:", err.Error())
+				lastError = err.Error()
+			}
+		} else {
+			writtenInWindow++
+			lastError = ""
+			counterData[DeadLetterWritten]++
+		}
+		pendingDeadLetters.Done()
+	}
+}
+
+// createDeadLetterSink starts writing dead letters to a file or a destination, if either was given
+func createDeadLetterSink() {
+	var write func([]byte) error
+	switch {
+	case *deadLetterFilename != "" && *deadLetterHostPort != "":
+		log.Println("Only one of -deadletterfile and -deadletterdestination may be given")
+		os.Exit(1)
+	case *deadLetterFilename != "":
+		sink := &deadLetterFile{filename: *deadLetterFilename, maxSize: *deadLetterMaxSize}
+		if err := sink.open(); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		write = sink.write
+	case *deadLetterHostPort != "":
+		sink := &deadLetterDestination{hostPort: *deadLetterHostPort}
+		write = sink.write
+	default:
+		return
+	}
+	deadLetterChannel = make(chan deadLetter, DeadLetterChannelSize)
+	go writeDeadLetters(write, *deadLetterRate)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Protocols for outgoing destinations
+const (
+	PlaintextProtocol = "plaintext"
+	PickleProtocol    = "pickle"
+)
+
+type outgoingDestination struct {
+	hostPort     string
+	protocol     string
+	batchSize    int
+	batchLatency time.Duration
+	tlsConfig    *tls.Config // Only set for TLS destinations
+	instance     string      // Instance name used for consistent hashing, like in carbon's DESTINATIONS
+	spool        bool        // Spool messages to disk when the destination can't keep up or can't be reached
+}
+
+// parseDestinationOptions applies the comma separated key=value options that may follow the host:port of a destination
+func parseDestinationOptions(hostPort string, options []string) (outgoingDestination, error) {
+	destination := outgoingDestination{
+		hostPort:     hostPort,
+		protocol:     PlaintextProtocol,
+		batchSize:    *pickleBatchSize,
+		batchLatency: time.Duration(*pickleMaxBatchLatency) * time.Millisecond,
+	}
+	var useTls bool
+	var caFile, certFile, keyFile, serverName string
+	for _, option := range options {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return destination, errors.New("Invalid destination option for " + hostPort + ": \"" + option + "\"")
+		}
+		switch keyValue[0] {
+		case "protocol":
+			if keyValue[1] != PlaintextProtocol && keyValue[1] != PickleProtocol {
+				return destination, errors.New("Invalid protocol for " + hostPort + ": \"" + keyValue[1] + "\"")
+			}
+			destination.protocol = keyValue[1]
+		case "batchsize":
+			batchSize, err := strconv.Atoi(keyValue[1])
+			if err != nil || batchSize < 1 {
+				return destination, errors.New("Invalid batchsize for " + hostPort + ": \"" + keyValue[1] + "\"")
+			}
+			destination.batchSize = batchSize
+		case "batchlatency":
+			batchLatency, err := strconv.ParseInt(keyValue[1], 10, 64)
+			if err != nil || batchLatency < 1 {
+				return destination, errors.New("Invalid batchlatency for " + hostPort + ": \"" + keyValue[1] + "\"")
+			}
+			destination.batchLatency = time.Duration(batchLatency) * time.Millisecond
+		case "tls":
+			var err error
+			if useTls, err = strconv.ParseBool(keyValue[1]); err != nil {
+				return destination, errors.New("Invalid tls for " + hostPort + ": \"" + keyValue[1] + "\"")
+			}
+		case "ca":
+			caFile = keyValue[1]
+		case "cert":
+			certFile = keyValue[1]
+		case "key":
+			keyFile = keyValue[1]
+		case "servername":
+			serverName = keyValue[1]
+		case "instance":
+			destination.instance = keyValue[1]
+		case "spool":
+			var err error
+			if destination.spool, err = strconv.ParseBool(keyValue[1]); err != nil {
+				return destination, errors.New("Invalid spool for " + hostPort + ": \"" + keyValue[1] + "\"")
+			}
+			if destination.spool && *spoolDirectory == "" {
+				return destination, errors.New("spool=true for " + hostPort + " requires -spooldirectory")
+			}
+		default:
+			return destination, errors.New("Unknown destination option for " + hostPort + ": \"" + keyValue[0] + "\"")
+		}
+	}
+
+	if !useTls {
+		if caFile != "" || certFile != "" || keyFile != "" || serverName != "" {
+			return destination, errors.New("TLS options given for " + hostPort + " without tls=true")
+		}
+		return destination, nil
+	}
+
+	// Verify against the host name of the destination, unless another name is given for SNI
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(hostPort)
+	}
+	destination.tlsConfig = &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		var err error
+		if destination.tlsConfig.RootCAs, err = loadCertificatePool(caFile); err != nil {
+			return destination, err
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return destination, errors.New("Failed to load client certificate for " + hostPort + ": " + err.Error())
+		}
+		destination.tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return destination, nil
+}
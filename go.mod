@@ -1,3 +1,5 @@
 module github.com/kambisports/hadrianus
 
-go 1.16
+go 1.22
+
+require github.com/klauspost/compress v1.18.0
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Routing algorithms for distributing messages within a destination pool
+const (
+	RoundRobinRouting  = "roundrobin"
+	CarbonChRouting    = "carbon_ch"     // The consistent hashing of carbon-relay's RELAY_METHOD = consistent-hashing
+	Fnv1aChRouting     = "fnv1a_ch"      // Carbon's and carbon-c-relay's fnv1a_ch, which hashes instance names instead of servers
+	JumpFnv1aChRouting = "jump_fnv1a_ch" // carbon-c-relay's jump_fnv1a_ch, the jump consistent hash of Lamping and Veach
+
+	HashRingReplicaCount = 100 // Positions of each destination on the ring, which carbon doesn't allow changing
+)
+
+// consistentHash picks the destinations in a pool for a metric path. Destinations for which isDown returns true are
+// only picked if there aren't enough others. isDown is nil when failover is disabled.
+type consistentHash interface {
+	getDestinations(key string, count int, destinations []int, isDown func(int) bool) []int
+}
+
+// poolRouting decides which destinations in a pool each message is sent to
+type poolRouting struct {
+	algorithm       string
+	replicas        int            // Number of destinations each message is sent to, like carbon's REPLICATION_FACTOR
+	diverseReplicas bool           // Send the replicas to different servers, like carbon's DIVERSE_REPLICAS, which is on by default
+	failover        bool           // Send messages to other destinations while theirs is down, which is off by default
+	hash            consistentHash // Only set for consistent hashing
+}
+
+// parsePoolRouting parses an algorithm followed by comma separated options, like "carbon_ch,replicas=2"
+func parsePoolRouting(routing string, destinations []outgoingDestination) (poolRouting, error) {
+	fields := strings.Split(routing, ",")
+	pool := poolRouting{algorithm: fields[0], replicas: 1, diverseReplicas: true}
+	for _, option := range fields[1:] {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return pool, errors.New("Invalid routing option \"" + option + "\" in " + routing)
+		}
+		switch keyValue[0] {
+		case "replicas":
+			replicas, err := strconv.Atoi(keyValue[1])
+			if err != nil || replicas < 1 {
+				return pool, errors.New("Invalid replicas \"" + keyValue[1] + "\" in " + routing)
+			}
+			pool.replicas = replicas
+		case "diversereplicas":
+			diverseReplicas, err := strconv.ParseBool(keyValue[1])
+			if err != nil {
+				return pool, errors.New("Invalid diversereplicas \"" + keyValue[1] + "\" in " + routing)
+			}
+			pool.diverseReplicas = diverseReplicas
+		case "failover":
+			failover, err := strconv.ParseBool(keyValue[1])
+			if err != nil {
+				return pool, errors.New("Invalid failover \"" + keyValue[1] + "\" in " + routing)
+			}
+			pool.failover = failover
+		default:
+			return pool, errors.New("Unknown routing option \"" + keyValue[0] + "\" in " + routing)
+		}
+	}
+
+	switch pool.algorithm {
+	case RoundRobinRouting:
+		if pool.replicas != 1 {
+			return pool, errors.New("Replicas can only be used with consistent hashing: " + routing)
+		}
+	case CarbonChRouting, Fnv1aChRouting:
+		if pool.replicas > len(destinations) {
+			return pool, errors.New("More replicas than destinations: " + routing)
+		}
+		ring, err := newHashRing(pool.algorithm, destinations, pool.diverseReplicas)
+		if err != nil {
+			return pool, err
+		}
+		if pool.diverseReplicas && pool.replicas > ring.servers {
+			return pool, errors.New("More replicas than servers, which diversereplicas=false allows: " + routing)
+		}
+		pool.hash = ring
+	case JumpFnv1aChRouting:
+		if pool.replicas != 1 {
+			return pool, errors.New("Replicas aren't supported with jump_fnv1a_ch: " + routing)
+		}
+		jump, err := newJumpHash(destinations)
+		if err != nil {
+			return pool, err
+		}
+		pool.hash = jump
+	default:
+		return pool, errors.New("Unknown routing algorithm \"" + pool.algorithm + "\" in " + routing)
+	}
+	return pool, nil
+}
+
+type hashRingEntry struct {
+	position    int
+	destination int // Index of the destination in its pool
+}
+
+// hashRing places destinations the same way as carbon's ConsistentHashRing, so that each metric path is
+// sent to the same carbon-cache that carbon-relay would send it to
+type hashRing struct {
+	entries           []hashRingEntry
+	destinations      int
+	servers           int      // Number of distinct servers
+	destinationServer []string // Server of each destination
+	diverseReplicas   bool
+	hash              func(string) int
+}
+
+// carbonHash is the position of a key on the carbon_ch ring: the first 16 bits of its MD5 sum
+func carbonHash(key string) int {
+	sum := md5.Sum([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]))
+}
+
+// fnv1aHash is the position of a key on the fnv1a_ch ring: the two halves of its 32 bit FNV-1a hash xored together
+func fnv1aHash(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	sum := hash.Sum32()
+	return int((sum >> 16) ^ (sum & 0xffff))
+}
+
+// newHashRing adds the destinations in order. Carbon identifies them by server and instance, but not port,
+// so for carbon_ch the key for a destination like "10.0.0.1:2004,instance=a" is "('10.0.0.1', 'a')", and
+// without an instance "('10.0.0.1', None)". fnv1a_ch only uses the instance, which then has to be given.
+func newHashRing(algorithm string, destinations []outgoingDestination, diverseReplicas bool) (*hashRing, error) {
+	ring := &hashRing{destinations: len(destinations), diverseReplicas: diverseReplicas, hash: carbonHash}
+	if algorithm == Fnv1aChRouting {
+		ring.hash = fnv1aHash
+	}
+	nodeKeys := make(map[string]bool)
+	servers := make(map[string]bool)
+	usedPositions := make(map[int]bool)
+	for index, destination := range destinations {
+		server, _, err := net.SplitHostPort(destination.hostPort)
+		if err != nil {
+			return nil, err
+		}
+		ring.destinationServer = append(ring.destinationServer, server)
+		servers[server] = true
+		var nodeKey string
+		if algorithm == Fnv1aChRouting {
+			if destination.instance == "" {
+				return nil, errors.New("Destinations need an instance option for fnv1a_ch: " + destination.hostPort)
+			}
+			nodeKey = destination.instance
+		} else if destination.instance != "" {
+			nodeKey = "('" + server + "', '" + destination.instance + "')"
+		} else {
+			nodeKey = "('" + server + "', None)"
+		}
+		if nodeKeys[nodeKey] {
+			return nil, errors.New("Destinations need different instance options for consistent hashing: " + destination.hostPort)
+		}
+		nodeKeys[nodeKey] = true
+
+		for replica := 0; replica < HashRingReplicaCount; replica++ {
+			var replicaKey string
+			if algorithm == Fnv1aChRouting {
+				replicaKey = strconv.Itoa(replica) + "-" + nodeKey
+			} else {
+				replicaKey = nodeKey + ":" + strconv.Itoa(replica)
+			}
+			position := ring.hash(replicaKey)
+			// Like carbon, move on to the next free position when it's taken
+			for usedPositions[position] {
+				position++
+			}
+			usedPositions[position] = true
+			ring.entries = append(ring.entries, hashRingEntry{position: position, destination: index})
+		}
+	}
+	sort.Slice(ring.entries, func(i, j int) bool { return ring.entries[i].position < ring.entries[j].position })
+	ring.servers = len(servers)
+	return ring, nil
+}
+
+// isPicked tells if a destination, or with diverse replicas another destination on the same server, has been picked
+func (ring *hashRing) isPicked(destinations []int, destination int) bool {
+	for _, earlier := range destinations {
+		if earlier == destination || ring.diverseReplicas && ring.destinationServer[earlier] == ring.destinationServer[destination] {
+			return true
+		}
+	}
+	return false
+}
+
+// getDestinations returns the first count distinct destinations found walking the ring from the position of the key.
+// Like in carbon, destinations on a server that has already been picked are passed over if replicas are diverse.
+// Destinations that are down are passed over, so that their messages go to the next ones on the ring, unless there
+// aren't enough destinations up. The destinations slice is reused for the result, to avoid allocating for every message.
+func (ring *hashRing) getDestinations(key string, count int, destinations []int, isDown func(int) bool) []int {
+	destinations = destinations[:0]
+	position := ring.hash(key)
+	index := sort.Search(len(ring.entries), func(i int) bool { return ring.entries[i].position >= position })
+	rerouted := false
+	for step := 0; step < len(ring.entries) && len(destinations) < count; step++ {
+		destination := ring.entries[(index+step)%len(ring.entries)].destination
+		if ring.isPicked(destinations, destination) {
+			continue
+		}
+		if isDown != nil && isDown(destination) {
+			rerouted = true
+			continue
+		}
+		destinations = append(destinations, destination)
+	}
+	if rerouted {
+		counterData[ReroutedMessage]++
+	}
+	for step := 0; step < len(ring.entries) && len(destinations) < count; step++ {
+		destination := ring.entries[(index+step)%len(ring.entries)].destination
+		if !ring.isPicked(destinations, destination) {
+			destinations = append(destinations, destination)
+		}
+	}
+	return destinations
+}
+
+// jumpHash orders the destinations by instance name, like carbon-c-relay does, since the jump consistent
+// hash picks a bucket number rather than a position on a ring
+type jumpHash struct {
+	buckets []int // Index of the destination in its pool, for each bucket
+}
+
+func newJumpHash(destinations []outgoingDestination) (*jumpHash, error) {
+	jump := &jumpHash{}
+	instances := make(map[string]bool)
+	for index, destination := range destinations {
+		if destination.instance == "" {
+			return nil, errors.New("Destinations need an instance option for jump_fnv1a_ch: " + destination.hostPort)
+		}
+		if instances[destination.instance] {
+			return nil, errors.New("Destinations need different instance options for consistent hashing: " + destination.hostPort)
+		}
+		instances[destination.instance] = true
+		jump.buckets = append(jump.buckets, index)
+	}
+	sort.Slice(jump.buckets, func(i, j int) bool {
+		return destinations[jump.buckets[i]].instance < destinations[jump.buckets[j]].instance
+	})
+	return jump, nil
+}
+
+// jumpBucket is the jump consistent hash from "A Fast, Minimal Memory, Consistent Hash Algorithm"
+func jumpBucket(key uint64, buckets int) int {
+	var bucket, next int64 = -1, 0
+	for next < int64(buckets) {
+		bucket = next
+		key = key*2862933555777941757 + 1
+		next = int64(float64(bucket+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(bucket)
+}
+
+// getDestinations passes over buckets whose destinations are down, to the following buckets in instance order
+func (jump *jumpHash) getDestinations(key string, count int, destinations []int, isDown func(int) bool) []int {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	bucket := jumpBucket(hash.Sum64(), len(jump.buckets))
+	if isDown != nil {
+		for step := 0; step < len(jump.buckets); step++ {
+			if !isDown(jump.buckets[(bucket+step)%len(jump.buckets)]) {
+				if step > 0 {
+					counterData[ReroutedMessage]++
+				}
+				bucket = (bucket + step) % len(jump.buckets)
+				break
+			}
+		}
+	}
+	return append(destinations[:0], jump.buckets[bucket])
+}
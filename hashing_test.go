@@ -0,0 +1,212 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// The expected destinations were computed with carbon's ConsistentHashRing and ConsistentHashingRouter for the same nodes.
+// With diverse replicas, destination 1 is passed over after destination 0, since both are on 10.0.0.1, and vice versa.
+func TestCarbonChPlacement(t *testing.T) {
+	destinations := []outgoingDestination{
+		{hostPort: "10.0.0.1:2004", instance: "a"},
+		{hostPort: "10.0.0.1:2104", instance: "b"},
+		{hostPort: "10.0.0.2:2004", instance: "a"},
+	}
+	tests := []struct {
+		key             string
+		count           int
+		diverseReplicas bool
+		expected        []int
+	}{
+		{"carbon.agents.host1.cpuUsage", 1, true, []int{1}},
+		{"carbon.agents.host1.cpuUsage", 2, true, []int{1, 2}},
+		{"carbon.agents.host1.cpuUsage", 3, false, []int{1, 2, 0}},
+		{"servers.web01.load.shortterm", 2, true, []int{2, 0}},
+		{"stats.counters.requests.count", 2, true, []int{1, 2}},
+		{"collectd.db02.memory.free", 2, true, []int{0, 2}},
+		{"collectd.db02.memory.free", 2, false, []int{0, 1}},
+		{"collectd.db02.memory.free", 3, false, []int{0, 1, 2}},
+		{"a", 2, true, []int{1, 2}},
+	}
+	for _, test := range tests {
+		ring, err := newHashRing(CarbonChRouting, destinations, test.diverseReplicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if destinations := ring.getDestinations(test.key, test.count, nil, nil); !reflect.DeepEqual(destinations, test.expected) {
+			t.Errorf("%s with diverse replicas %t: got destinations %v, expected %v", test.key, test.diverseReplicas, destinations, test.expected)
+		}
+	}
+}
+
+func TestParsePoolRoutingReplicas(t *testing.T) {
+	destinations := []outgoingDestination{
+		{hostPort: "10.0.0.1:2004", instance: "a"},
+		{hostPort: "10.0.0.1:2104", instance: "b"},
+		{hostPort: "10.0.0.2:2004", instance: "a"},
+	}
+	tests := []struct {
+		routing string
+		isError bool
+	}{
+		{"carbon_ch,replicas=2", false},
+		{"carbon_ch,replicas=3", true},
+		{"carbon_ch,replicas=3,diversereplicas=false", false},
+		{"carbon_ch,replicas=4,diversereplicas=false", true},
+		{"carbon_ch,diversereplicas=maybe", true},
+	}
+	for _, test := range tests {
+		if _, err := parsePoolRouting(test.routing, destinations); (err != nil) != test.isError {
+			t.Errorf("%s: got error %v", test.routing, err)
+		}
+	}
+}
+
+func TestCarbonChPosition(t *testing.T) {
+	tests := []struct {
+		key      string
+		position int
+	}{
+		{"carbon.agents.host1.cpuUsage", 33337},
+		{"servers.web01.load.shortterm", 3998},
+		{"a", 3265},
+	}
+	for _, test := range tests {
+		if position := carbonHash(test.key); position != test.position {
+			t.Errorf("%s: got position %d, expected %d", test.key, position, test.position)
+		}
+	}
+}
+
+func TestHashRingFailover(t *testing.T) {
+	destinations := []outgoingDestination{
+		{hostPort: "10.0.0.1:2004", instance: "a"},
+		{hostPort: "10.0.0.1:2104", instance: "b"},
+		{hostPort: "10.0.0.2:2004", instance: "a"},
+	}
+	tests := []struct {
+		name            string
+		count           int
+		diverseReplicas bool
+		down            map[int]bool
+		expected        []int
+	}{
+		{"nothing down", 1, true, map[int]bool{}, []int{1}},
+		{"first down", 1, true, map[int]bool{1: true}, []int{2}},
+		{"first two down", 1, true, map[int]bool{1: true, 2: true}, []int{0}},
+		{"replica down", 2, false, map[int]bool{2: true}, []int{1, 0}},
+		{"replica on the only other server down", 2, true, map[int]bool{2: true}, []int{1, 2}},
+		{"all down", 2, true, map[int]bool{0: true, 1: true, 2: true}, []int{1, 2}},
+	}
+	for _, test := range tests {
+		ring, err := newHashRing(CarbonChRouting, destinations, test.diverseReplicas)
+		if err != nil {
+			t.Fatal(err)
+		}
+		isDown := func(destination int) bool { return test.down[destination] }
+		if destinations := ring.getDestinations("carbon.agents.host1.cpuUsage", test.count, nil, isDown); !reflect.DeepEqual(destinations, test.expected) {
+			t.Errorf("%s: got destinations %v, expected %v", test.name, destinations, test.expected)
+		}
+	}
+}
+
+func TestNewHashRingErrors(t *testing.T) {
+	tests := []struct {
+		name         string
+		algorithm    string
+		destinations []outgoingDestination
+	}{
+		{"same server without instances", CarbonChRouting, []outgoingDestination{{hostPort: "10.0.0.1:2004"}, {hostPort: "10.0.0.1:2104"}}},
+		{"same server and instance", CarbonChRouting, []outgoingDestination{{hostPort: "10.0.0.1:2004", instance: "a"}, {hostPort: "10.0.0.1:2104", instance: "a"}}},
+		{"invalid address", CarbonChRouting, []outgoingDestination{{hostPort: "10.0.0.1"}}},
+		{"fnv1a_ch without instance", Fnv1aChRouting, []outgoingDestination{{hostPort: "10.0.0.1:2003"}}},
+		{"fnv1a_ch with same instance", Fnv1aChRouting, []outgoingDestination{{hostPort: "10.0.0.1:2003", instance: "a"}, {hostPort: "10.0.0.2:2003", instance: "a"}}},
+	}
+	for _, test := range tests {
+		if _, err := newHashRing(test.algorithm, test.destinations, true); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+// The expected destinations were computed with carbon's fnv1a_ch ring and carbon-c-relay's jump_fnv1a_ch
+func TestFnv1aChPlacement(t *testing.T) {
+	destinations := []outgoingDestination{
+		{hostPort: "10.0.0.1:2003", instance: "a"},
+		{hostPort: "10.0.0.2:2003", instance: "b"},
+		{hostPort: "10.0.0.3:2003", instance: "c"},
+	}
+	ring, err := newHashRing(Fnv1aChRouting, destinations, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key      string
+		count    int
+		expected []int
+	}{
+		{"carbon.agents.host1.cpuUsage", 2, []int{0, 1}},
+		{"servers.web01.load.shortterm", 2, []int{1, 2}},
+		{"stats.counters.requests.count", 1, []int{0}},
+		{"collectd.db02.memory.free", 2, []int{0, 1}},
+		{"a", 2, []int{0, 2}},
+	}
+	for _, test := range tests {
+		if destinations := ring.getDestinations(test.key, test.count, nil, nil); !reflect.DeepEqual(destinations, test.expected) {
+			t.Errorf("%s: got destinations %v, expected %v", test.key, destinations, test.expected)
+		}
+	}
+}
+
+func TestJumpFnv1aChPlacement(t *testing.T) {
+	// Buckets are in instance order: destinations 1, 2, 0 and 3
+	destinations := []outgoingDestination{
+		{hostPort: "10.0.0.1:2003", instance: "c"},
+		{hostPort: "10.0.0.2:2003", instance: "a"},
+		{hostPort: "10.0.0.3:2003", instance: "b"},
+		{hostPort: "10.0.0.4:2003", instance: "d"},
+	}
+	jump, err := newJumpHash(destinations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key         string
+		destination int
+	}{
+		{"metric.0", 2},
+		{"metric.1", 3},
+		{"metric.3", 2},
+		{"metric.4", 0},
+		{"metric.5", 3},
+		{"metric.6", 1},
+	}
+	for _, test := range tests {
+		if destinations := jump.getDestinations(test.key, 1, nil, nil); !reflect.DeepEqual(destinations, []int{test.destination}) {
+			t.Errorf("%s: got destinations %v, expected [%d]", test.key, destinations, test.destination)
+		}
+	}
+
+	// metric.4 is in bucket 2. While its destination is down, it goes to the next bucket, and from the last bucket to the first.
+	isDown := func(destination int) bool { return destination == 0 }
+	if destinations := jump.getDestinations("metric.4", 1, nil, isDown); !reflect.DeepEqual(destinations, []int{3}) {
+		t.Errorf("metric.4 with its destination down: got destinations %v, expected [3]", destinations)
+	}
+	isDown = func(destination int) bool { return destination == 0 || destination == 3 }
+	if destinations := jump.getDestinations("metric.4", 1, nil, isDown); !reflect.DeepEqual(destinations, []int{1}) {
+		t.Errorf("metric.4 with the last buckets down: got destinations %v, expected [1]", destinations)
+	}
+}
+
+func TestJumpBucket(t *testing.T) {
+	// With a single bucket, every key is in it, and the bucket never exceeds the number of buckets
+	for key := uint64(0); key < 1000; key++ {
+		if bucket := jumpBucket(key, 1); bucket != 0 {
+			t.Fatalf("key %d: got bucket %d with one bucket", key, bucket)
+		}
+		if bucket := jumpBucket(key*0x9e3779b97f4a7c15, 7); bucket < 0 || bucket >= 7 {
+			t.Fatalf("key %d: got bucket %d with seven buckets", key, bucket)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path of the graphite HTTP ingest endpoint
+const GraphiteHttpPath = "/graphite"
+
+type httpIngestResult struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+type httpJsonMetric struct {
+	Path      string       `json:"path"`
+	Value     *json.Number `json:"value"`
+	Timestamp *json.Number `json:"timestamp"`
+}
+
+func createHttpListener(listenAddress string, profile *policyProfile, incomingMessageChannel chan metricMessage) {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc(GraphiteHttpPath, func(responseWriter http.ResponseWriter, request *http.Request) {
+		handleGraphiteHttpRequest(responseWriter, request, messageOrigin{source: request.RemoteAddr, profile: profile}, incomingMessageChannel)
+	})
+	influx := createInfluxConverter()
+	serveMux.HandleFunc(InfluxHttpPath, func(responseWriter http.ResponseWriter, request *http.Request) {
+		influx.handleHttpRequest(responseWriter, request, messageOrigin{source: request.RemoteAddr, profile: profile}, incomingMessageChannel)
+	})
+	prometheus := createPrometheusConverter()
+	serveMux.HandleFunc(PrometheusHttpPath, func(responseWriter http.ResponseWriter, request *http.Request) {
+		prometheus.handleHttpRequest(responseWriter, request, messageOrigin{source: request.RemoteAddr, profile: profile}, incomingMessageChannel)
+	})
+	otlp := createOtlpConverter()
+	serveMux.HandleFunc(OtlpHttpPath, func(responseWriter http.ResponseWriter, request *http.Request) {
+		otlp.handleHttpRequest(responseWriter, request, messageOrigin{source: request.RemoteAddr, profile: profile}, incomingMessageChannel)
+	})
+
+	// A request has -idletimeout seconds to arrive, like a line, and -readtimeout seconds to arrive in full
+	server := &http.Server{
+		Handler:           serveMux,
+		ReadHeaderTimeout: time.Duration(*idleTimeout) * time.Second,
+		ReadTimeout:       time.Duration(*readTimeout) * time.Second,
+		IdleTimeout:       time.Duration(*idleTimeout) * time.Second,
+	}
+	listen := limitingListener{createListener(listenAddress)}
+	defer listen.Close()
+	if err := server.Serve(listen); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+// acceptHttpPost counts a request to any of the HTTP endpoints, and replies with 405 unless it is a POST.
+// The body of accepted requests is limited to -httpmaxbodysize.
+func acceptHttpPost(responseWriter http.ResponseWriter, request *http.Request) bool {
+	counterData[HttpRequest]++
+	if request.Method != http.MethodPost {
+		counterData[HttpRequestRejected]++
+		responseWriter.Header().Set("Allow", http.MethodPost)
+		http.Error(responseWriter, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	request.Body = http.MaxBytesReader(responseWriter, request.Body, *httpMaxBodySize)
+	return true
+}
+
+// handleGraphiteHttpRequest accepts a body of plaintext graphite lines, or a JSON array of
+// {"path", "value", "timestamp"} objects, and replies with the number of accepted and rejected metrics
+func handleGraphiteHttpRequest(responseWriter http.ResponseWriter, request *http.Request, origin messageOrigin, incomingMessageChannel chan metricMessage) {
+	if !acceptHttpPost(responseWriter, request) {
+		return
+	}
+
+	var result httpIngestResult
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "application/json") {
+		var jsonMetrics []httpJsonMetric
+		if err := json.NewDecoder(request.Body).Decode(&jsonMetrics); err != nil {
+			counterData[HttpRequestRejected]++
+			http.Error(responseWriter, "Invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, jsonMetric := range jsonMetrics {
+			countHttpIngestResult(&result, processIncomingLine(jsonMetricToGraphiteLine(jsonMetric), origin, incomingMessageChannel))
+		}
+	} else {
+		scanner := bufio.NewScanner(request.Body)
+		scanner.Buffer(make([]byte, 0, 4096), int(*httpMaxBodySize))
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			countHttpIngestResult(&result, processIncomingLine(scanner.Text(), origin, incomingMessageChannel))
+		}
+		if err := scanner.Err(); err != nil {
+			counterData[HttpRequestRejected]++
+			http.Error(responseWriter, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(responseWriter).Encode(result)
+}
+
+// jsonMetricToGraphiteLine formats a JSON metric as a plaintext line, so that it is validated exactly like
+// plaintext messages are. A missing timestamp means "now", just like -1 does in the plaintext protocol.
+func jsonMetricToGraphiteLine(jsonMetric httpJsonMetric) string {
+	value := ""
+	if jsonMetric.Value != nil {
+		value = jsonMetric.Value.String()
+	}
+	timestamp := "-1"
+	if jsonMetric.Timestamp != nil {
+		timestamp = jsonMetric.Timestamp.String()
+		if floatTimestamp, err := jsonMetric.Timestamp.Float64(); err == nil {
+			timestamp = strconv.FormatInt(int64(floatTimestamp), 10)
+		}
+	}
+	return jsonMetric.Path + " " + value + " " + timestamp
+}
+
+func countHttpIngestResult(result *httpIngestResult, err error) {
+	if err != nil {
+		result.Rejected++
+	} else {
+		result.Accepted++
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path of the InfluxDB compatible HTTP endpoint
+const InfluxHttpPath = "/write"
+
+type influxTemplateData struct {
+	Measurement string
+	Field       string
+	Tags        map[string]string
+}
+
+// influxConverter translates InfluxDB line protocol into graphite messages
+type influxConverter struct {
+	metricPathTemplate *template.Template
+	graphiteTags       bool // Append the influx tags as graphite tags
+}
+
+// Multipliers from the influx precision names to nanoseconds
+var influxPrecisionNanoseconds = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1000,
+	"us": 1000,
+	"µ":  1000,
+	"ms": 1000000,
+	"s":  1000000000,
+}
+
+func newInfluxConverter(metricPathTemplate string, graphiteTags bool) (*influxConverter, error) {
+	parsedTemplate, err := template.New("influxMetricPath").Parse(metricPathTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &influxConverter{metricPathTemplate: parsedTemplate, graphiteTags: graphiteTags}, nil
+}
+
+// convertLine turns one line of line protocol into one graphite message per numeric or boolean field.
+// String fields can't be represented in graphite and are skipped.
+func (converter *influxConverter) convertLine(line string, precision string) ([]metricMessage, error) {
+	sections := splitInfluxUnescaped(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, errors.New("Wrong number of sections in influx line: " + line)
+	}
+
+	keyParts := splitInfluxUnescaped(sections[0], ',')
+	measurement := unescapeInflux(keyParts[0])
+	if measurement == "" {
+		return nil, errors.New("Missing measurement in influx line: " + line)
+	}
+	tags := make(map[string]string, len(keyParts)-1)
+	for _, tagText := range keyParts[1:] {
+		keyValue := splitInfluxUnescaped(tagText, '=')
+		if len(keyValue) != 2 || keyValue[0] == "" || keyValue[1] == "" {
+			return nil, errors.New("Invalid tag in influx line: " + line)
+		}
+		tags[sanitizePathComponent(unescapeInflux(keyValue[0]))] = sanitizePathComponent(unescapeInflux(keyValue[1]))
+	}
+
+	timestamp := time.Now().Unix()
+	if len(sections) == 3 {
+		nanosecondsPerUnit, ok := influxPrecisionNanoseconds[precision]
+		if !ok {
+			return nil, errors.New("Invalid influx precision: " + precision)
+		}
+		rawTimestamp, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid timestamp in influx line: " + line)
+		}
+		timestamp = rawTimestamp * nanosecondsPerUnit / int64(time.Second)
+	}
+
+	var outputMessages []metricMessage
+	for _, fieldText := range splitInfluxUnescaped(sections[1], ',') {
+		keyValue := splitInfluxUnescaped(fieldText, '=')
+		if len(keyValue) != 2 || keyValue[0] == "" || keyValue[1] == "" {
+			return nil, errors.New("Invalid field in influx line: " + line)
+		}
+		value, numeric, err := parseInfluxFieldValue(keyValue[1])
+		if err != nil {
+			return nil, errors.New("Invalid field value in influx line: " + line)
+		}
+		if !numeric {
+			continue
+		}
+
+		metricPath, err := converter.metricPath(sanitizePathComponent(measurement), sanitizePathComponent(unescapeInflux(keyValue[0])), tags)
+		if err != nil {
+			return nil, err
+		}
+		outputMessages = append(outputMessages, metricMessage{metricPath: metricPath, value: value, timestamp: timestamp})
+	}
+	return outputMessages, nil
+}
+
+// metricPath renders the template and, if enabled, appends the tags as normalized graphite tags.
+// Empty path components, for example from missing tags, are removed.
+func (converter *influxConverter) metricPath(measurement string, field string, tags map[string]string) (string, error) {
+	var templateOutputBuffer bytes.Buffer
+	if err := converter.metricPathTemplate.Execute(&templateOutputBuffer, influxTemplateData{Measurement: measurement, Field: field, Tags: tags}); err != nil {
+		return "", err
+	}
+	metricPath := removeEmptyPathComponents(templateOutputBuffer.String())
+	if metricPath == "" {
+		return "", errors.New("Influx metric path template rendered an empty path")
+	}
+	if converter.graphiteTags {
+		metricPath = appendGraphiteTags(metricPath, tags)
+	}
+	return metricPath, nil
+}
+
+// parseInfluxFieldValue parses floats, integers (123i), unsigned integers (123u) and booleans, which become 1 or 0.
+// Strings are valid, but not numeric.
+func parseInfluxFieldValue(text string) (float64, bool, error) {
+	switch text {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if strings.HasPrefix(text, `"`) {
+		if len(text) < 2 || !strings.HasSuffix(text, `"`) {
+			return 0, false, errors.New("Unterminated string field value")
+		}
+		return 0, false, nil
+	}
+	if strings.HasSuffix(text, "i") {
+		value, err := strconv.ParseInt(strings.TrimSuffix(text, "i"), 10, 64)
+		return float64(value), true, err
+	}
+	if strings.HasSuffix(text, "u") {
+		value, err := strconv.ParseUint(strings.TrimSuffix(text, "u"), 10, 64)
+		return float64(value), true, err
+	}
+	// Non-finite values are handled by validateMetricMessage, like for the other protocols
+	value, err := strconv.ParseFloat(text, 64)
+	return value, true, err
+}
+
+// splitInfluxUnescaped splits on a separator that isn't escaped with a backslash or within a double quoted string
+func splitInfluxUnescaped(text string, separator byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(text); i++ {
+		switch {
+		case text[i] == '\\':
+			i++
+		case text[i] == '"':
+			inQuotes = !inQuotes
+		case text[i] == separator && !inQuotes:
+			parts = append(parts, text[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, text[start:])
+}
+
+func unescapeInflux(text string) string {
+	if !strings.Contains(text, `\`) {
+		return text
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && strings.IndexByte(`, ="\`, text[i+1]) >= 0 {
+			i++
+		}
+		unescaped.WriteByte(text[i])
+	}
+	return unescaped.String()
+}
+
+// processInfluxLine converts and forwards one line, and returns the error if the line is invalid
+func (converter *influxConverter) processInfluxLine(line string, precision string, origin messageOrigin, incomingMessageChannel chan metricMessage) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	counterData[InfluxReceivedLine]++
+	incomingMessages, err := converter.convertLine(line, precision)
+	if err != nil {
+		counterData[InfluxInvalidLine]++
+		recordDeadLetter(InfluxInvalidLine, origin, line)
+		countClientInvalidMessage(origin)
+		return err
+	}
+	for i := range incomingMessages {
+		if incomingMessages[i].metricPath, err = normalizeMetricPath(incomingMessages[i].metricPath); err != nil {
+			counterData[InfluxInvalidLine]++
+			recordDeadLetter(InfluxInvalidLine, origin, line)
+			countClientInvalidMessage(origin)
+			return err
+		}
+		if err = validateMetricMessage(incomingMessages[i], "influx line"); err != nil {
+			counterData[InfluxInvalidLine]++
+			recordDeadLetter(countInvalidMessage(err), origin, line)
+			countClientInvalidMessage(origin)
+			return err
+		}
+	}
+	for _, incomingMessage := range incomingMessages {
+		incomingMessage.messageOrigin = origin
+		writeIncomingMessage(incomingMessageChannel, incomingMessage)
+	}
+	return nil
+}
+
+func (converter *influxConverter) handleIncomingConnection(connection net.Conn, profile *policyProfile, incomingMessageChannel chan metricMessage) {
+	defer connection.Close()
+	if err := readProxyProtocolHeader(connection); err != nil {
+		return
+	}
+	reader := bufio.NewReader(connection)
+	origin := messageOrigin{source: connection.RemoteAddr().String(), profile: profile}
+	counterData[ClientConnectionOpening]++
+	gaugeData[ClientConnectionsActive]++
+	for {
+		netData, err := readLimitedLine(connection, reader)
+		if err == errLineTooLong {
+			continue
+		}
+		if err != nil {
+			break // Break out of for loop and close connection
+		}
+		converter.processInfluxLine(netData, *influxPrecision, origin, incomingMessageChannel)
+	}
+	counterData[ClientConnectionClosing]++
+	gaugeData[ClientConnectionsActive]--
+}
+
+// handleHttpRequest implements the InfluxDB 1.x /write endpoint. Like InfluxDB, it replies with
+// 204 if all lines were written, and with 400 and the first error if any line was invalid.
+func (converter *influxConverter) handleHttpRequest(responseWriter http.ResponseWriter, request *http.Request, origin messageOrigin, incomingMessageChannel chan metricMessage) {
+	if !acceptHttpPost(responseWriter, request) {
+		return
+	}
+	precision := request.URL.Query().Get("precision")
+	if _, ok := influxPrecisionNanoseconds[precision]; !ok {
+		counterData[HttpRequestRejected]++
+		writeInfluxHttpError(responseWriter, "invalid precision: "+precision)
+		return
+	}
+
+	var firstError error
+	invalidLines := 0
+	scanner := bufio.NewScanner(request.Body)
+	scanner.Buffer(make([]byte, 0, 4096), int(*httpMaxBodySize))
+	for scanner.Scan() {
+		if err := converter.processInfluxLine(scanner.Text(), precision, origin, incomingMessageChannel); err != nil {
+			invalidLines++
+			if firstError == nil {
+				firstError = err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		counterData[HttpRequestRejected]++
+		writeInfluxHttpError(responseWriter, err.Error())
+		return
+	}
+	if firstError != nil {
+		writeInfluxHttpError(responseWriter, "partial write: "+strconv.Itoa(invalidLines)+" invalid lines, first error: "+firstError.Error())
+		return
+	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func writeInfluxHttpError(responseWriter http.ResponseWriter, message string) {
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(responseWriter).Encode(map[string]string{"error": message})
+}
+
+func createInfluxConverter() *influxConverter {
+	converter, err := newInfluxConverter(*influxMetricPath, *influxGraphiteTags)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	return converter
+}
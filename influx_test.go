@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConvertInfluxLine(t *testing.T) {
+	converter, err := newInfluxConverter(InfluxMetricPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		line     string
+		expected []metricMessage
+	}{
+		{"float", "cpu,host=a usage=1.5 1700000000000000000", []metricMessage{{metricPath: "cpu.usage;host=a", value: 1.5, timestamp: 1700000000}}},
+		{"integer, unsigned and booleans", "cpu a=3i,b=4u,c=t,d=FALSE 1700000000000000000", []metricMessage{
+			{metricPath: "cpu.a", value: 3, timestamp: 1700000000},
+			{metricPath: "cpu.b", value: 4, timestamp: 1700000000},
+			{metricPath: "cpu.c", value: 1, timestamp: 1700000000},
+			{metricPath: "cpu.d", value: 0, timestamp: 1700000000},
+		}},
+		{"tags sorted like graphite", "cpu,host=a,host2=b,dc=x v=1 1700000000000000000", []metricMessage{{metricPath: "cpu.v;dc=x;host2=b;host=a", value: 1, timestamp: 1700000000}}},
+		{"escaped spaces", `my\ cpu,host\ name=web\ 1 us\ age=2 1700000000000000000`, []metricMessage{{metricPath: "my_cpu.us_age;host_name=web_1", value: 2, timestamp: 1700000000}}},
+		{"escaped commas", `cpu\,x,dc=eu\,west lo\,ad=1 1700000000000000000`, []metricMessage{{metricPath: "cpu_x.lo_ad;dc=eu_west", value: 1, timestamp: 1700000000}}},
+		{"escaped equals signs", `cpu,a\=b=c\=d v\=w=1 1700000000000000000`, []metricMessage{{metricPath: "cpu.v_w;a_b=c_d", value: 1, timestamp: 1700000000}}},
+		{"quoted string with separators", `cpu,host=a status="ok, fine=yes now",v=3i 1700000000000000000`, []metricMessage{{metricPath: "cpu.v;host=a", value: 3, timestamp: 1700000000}}},
+		{"quoted string with escaped quotes", `cpu msg="say \"hi, there\"",v=1 1700000000000000000`, []metricMessage{{metricPath: "cpu.v", value: 1, timestamp: 1700000000}}},
+		{"only string fields", `cpu msg="hello" 1700000000000000000`, nil},
+		{"name tag", "cpu,name=x v=1 1700000000000000000", []metricMessage{{metricPath: "cpu.v", value: 1, timestamp: 1700000000}}},
+	}
+	for _, test := range tests {
+		messages, err := converter.convertLine(test.line, "")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(messages, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, messages, test.expected)
+		}
+	}
+}
+
+func TestConvertInfluxLinePrecision(t *testing.T) {
+	converter, err := newInfluxConverter(InfluxMetricPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		precision string
+		timestamp string
+	}{
+		{"", "1700000000123456789"},
+		{"n", "1700000000123456789"},
+		{"ns", "1700000000123456789"},
+		{"u", "1700000000123456"},
+		{"us", "1700000000123456"},
+		{"µ", "1700000000123456"},
+		{"ms", "1700000000123"},
+		{"s", "1700000000"},
+	}
+	for _, test := range tests {
+		messages, err := converter.convertLine("cpu v=1 "+test.timestamp, test.precision)
+		if err != nil || len(messages) != 1 || messages[0].timestamp != 1700000000 {
+			t.Errorf("precision %q: got %v and error %v, expected timestamp 1700000000", test.precision, messages, err)
+		}
+	}
+	if _, err := converter.convertLine("cpu v=1 1700000000", "m"); err == nil {
+		t.Error("precision m: expected an error")
+	}
+}
+
+// Lines without a timestamp get the time they are received
+func TestConvertInfluxLineWithoutTimestamp(t *testing.T) {
+	converter, err := newInfluxConverter(InfluxMetricPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Unix()
+	messages, err := converter.convertLine("cpu,host=a v=1", "s")
+	after := time.Now().Unix()
+	if err != nil || len(messages) != 1 || messages[0].metricPath != "cpu.v" || messages[0].timestamp < before || messages[0].timestamp > after {
+		t.Errorf("got %v and error %v, expected cpu.v with a timestamp between %d and %d", messages, err, before, after)
+	}
+}
+
+func TestConvertInfluxLineErrors(t *testing.T) {
+	converter, err := newInfluxConverter(InfluxMetricPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"missing fields", "cpu,host=a"},
+		{"too many sections", "cpu v=1 1700000000000000000 x"},
+		{"missing measurement", ",host=a v=1"},
+		{"tag without value", "cpu,host v=1"},
+		{"tag with empty value", "cpu,host= v=1"},
+		{"field without value", "cpu v 1700000000000000000"},
+		{"field with empty name", "cpu =1"},
+		{"invalid float", "cpu v=x"},
+		{"invalid integer", "cpu v=1.5i"},
+		{"negative unsigned", "cpu v=-1u"},
+		{"unterminated string", `cpu v="abc`},
+		{"invalid timestamp", "cpu v=1 17e8"},
+	}
+	for _, test := range tests {
+		if messages, err := converter.convertLine(test.line, ""); err == nil {
+			t.Errorf("%s: got %v, expected an error", test.name, messages)
+		}
+	}
+}
+
+// Tags can be used in the template, and the components of missing tags are left out
+func TestInfluxMetricPathTemplate(t *testing.T) {
+	converter, err := newInfluxConverter(`{{ index .Tags "dc"}}.{{ .Measurement}}.{{ index .Tags "host"}}.{{ .Field}}`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"cpu,host=a,dc=x v=1", "x.cpu.a.v"},
+		{"cpu,host=a v=1", "cpu.a.v"},
+		{"cpu v=1", "cpu.v"},
+	}
+	for _, test := range tests {
+		messages, err := converter.convertLine(test.line, "")
+		if err != nil || len(messages) != 1 || messages[0].metricPath != test.expected {
+			t.Errorf("%s: got %v and error %v, expected %s", test.line, messages, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	InputStdin          = "-"
+	InputFollowInterval = time.Second // How often a followed file is checked for new lines, truncation and rotation
+)
+
+// inputPacer replays messages at the pace of their timestamps, sped up by a factor. Messages with
+// timestamps that are missing, -1 or earlier than the ones before them are sent right away.
+type inputPacer struct {
+	speed          float64
+	firstTimestamp float64
+	start          time.Time
+}
+
+func (pacer *inputPacer) wait(line string) {
+	if pacer.speed <= 0 {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return
+	}
+	timestamp, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil || timestamp < 0 {
+		return
+	}
+	if pacer.start.IsZero() {
+		pacer.start = time.Now()
+		pacer.firstTimestamp = timestamp
+		return
+	}
+	sendTime := pacer.start.Add(time.Duration((timestamp - pacer.firstTimestamp) / pacer.speed * float64(time.Second)))
+	if delay := time.Until(sendTime); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// followedFile reopens a followed file when it has been rotated, and rewinds it when it has been truncated, like tail -F
+type followedFile struct {
+	filename string
+	file     *os.File
+}
+
+// checkRotation is called at the end of the file, when everything written to it so far has been read
+func (followed *followedFile) checkRotation() (bool, error) {
+	pathInfo, err := os.Stat(followed.filename)
+	if err != nil {
+		// The file may be about to be recreated after a rotation, so keep reading the old one until it is
+		return false, nil
+	}
+	fileInfo, err := followed.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !os.SameFile(pathInfo, fileInfo) {
+		file, err := os.Open(followed.filename)
+		if err != nil {
+			return false, nil
+		}
+		followed.file.Close()
+		followed.file = file
+		return true, nil
+	}
+	offset, err := followed.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	if fileInfo.Size() < offset {
+		_, err = followed.file.Seek(0, io.SeekStart)
+		return true, err
+	}
+	return false, nil
+}
+
+// readInput reads plaintext graphite lines from stdin or a file, like they were sent by a client. It returns at the
+// end of the input, or never if the file is followed. Lines longer than -maxlinelength are discarded.
+func readInput(filename string, follow bool, pace float64, incomingMessageChannel chan metricMessage) error {
+	var followed *followedFile
+	file := os.Stdin
+	if filename != InputStdin {
+		var err error
+		if file, err = os.Open(filename); err != nil {
+			return err
+		}
+		if follow {
+			followed = &followedFile{filename: filename, file: file}
+			// Like tail -F, only the lines written after starting are read
+			if _, err := file.Seek(0, io.SeekEnd); err != nil {
+				return err
+			}
+		}
+		defer func() { file.Close() }()
+	}
+
+	pacer := inputPacer{speed: pace}
+	reader := bufio.NewReader(file)
+	handleLine := func(line string) {
+		pacer.wait(line)
+		processIncomingLine(line, messageOrigin{}, incomingMessageChannel)
+	}
+
+	var line []byte
+	tooLong := false
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		if !tooLong {
+			if *maxLineLength > 0 && len(line)+len(fragment) > *maxLineLength {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, fragment...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && followed != nil {
+			// Keep any partial line, until the rest of it has been written
+			time.Sleep(InputFollowInterval)
+			reopened, err := followed.checkRotation()
+			if err != nil {
+				return err
+			}
+			if reopened {
+				// A partial line at the end of a rotated or truncated file will never be finished
+				file = followed.file
+				reader.Reset(file)
+				line = nil
+				tooLong = false
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if tooLong {
+			counterData[OversizedLine]++
+		} else if strings.TrimSpace(string(line)) != "" {
+			handleLine(string(line))
+		}
+		if err == io.EOF {
+			return nil
+		}
+		line = nil
+		tooLong = false
+	}
+}
+
+func validateInputFlags() error {
+	if *inputFollow && (*inputFile == "" || *inputFile == InputStdin) {
+		return errors.New("-inputfollow requires -input with a filename")
+	}
+	if *inputPace < 0 {
+		return errors.New("Invalid value for -inputpace: " + strconv.FormatFloat(*inputPace, 'f', -1, 64))
+	}
+	return nil
+}
+
+// createInputReader reads the input in the background, and closes the returned channel at the end of it
+func createInputReader(incomingMessageChannel chan metricMessage) chan struct{} {
+	inputDone := make(chan struct{})
+	go func() {
+		if err := readInput(*inputFile, *inputFollow, *inputPace, incomingMessageChannel); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		close(inputDone)
+	}()
+	return inputDone
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"net"
 	"os"
-	"regexp"
 	"runtime"
 	"runtime/debug"
 	"strconv"
@@ -31,12 +31,37 @@ const (
 	MaxDryLimit                 = 172800 // The maximum number of messages that dry threshold may be increased to
 	IsNewMetricEnabledByDefault = false
 	StaleResendInterval         = 0
+	UdpReadBufferSize           = 65536
+	MaxPickleFrameSize          = 1048576 // Same as the carbon default
+	HttpMaxBodySize             = 33554432
+	MaxLineLength               = 16384
+	StatsdFlushInterval         = MinimumTimeInterval // Flushing more often would have every other flush discarded as chatty
+	StatsdPercentiles           = "90"
+	InfluxGraphiteTags          = true
+	InfluxPrecision             = "ns"
+	PrometheusGraphiteTags      = true
+	OtlpGraphiteTags            = true
+	OtlpResourceTags            = "service.name"
+	PickleBatchSize             = 500 // Same as the carbon default
+	PickleMaxBatchLatency       = 1000
+	DeadLetterMaxSize           = 104857600
+	DeadLetterRate              = 100
+	ReconnectInterval           = 500   // Milliseconds before the first attempt to reconnect to a destination
+	ReconnectMaxInterval        = 30000 // The interval is doubled after each failed attempt, up to this many milliseconds
+	DestinationDialTimeout      = 5 * time.Second
+	SpoolMaxSize                = 1073741824
+	SpoolSegmentSize            = 67108864
+	SpoolReplayRate             = 10000
 
 	BlockOnChannelBufferFullDefault = true
 	TcpNoDelay                      = false // Disable delay of sending successive small packets
 	OverflowsThreshold              = 10    // When more than this number of consecutive overflows have occured, discard data to queues
 
-	InternalMetricPath = `server.hadrianus.{{ .Host}}.{{ .Metric}}`
+	InternalMetricPath   = `server.hadrianus.{{ .Host}}.{{ .Metric}}`
+	StatsdMetricPath     = `stats.{{ .Type}}.{{ .Metric}}`
+	InfluxMetricPath     = `{{ .Measurement}}.{{ .Field}}`
+	PrometheusMetricPath = `{{ .Name}}`
+	OtlpMetricPath       = `{{ .Name}}`
 )
 
 // Commandline flag variable definitions
@@ -49,10 +74,67 @@ var (
 	staleResendInterval         = flag.Int64("staleresendinterval", StaleResendInterval, "time after which stale messages are resent in seconds")
 	mirrorDestination           = flag.String("mirrordestination", "", "secondary destinations to mirror traffic to")
 	tertiaryDestination         = flag.String("tertiarydestination", "", "tertiary destinations to mirror traffic to")
+	routing                     = flag.String("routing", RoundRobinRouting, "algorithm for distributing messages to the destinations: roundrobin, carbon_ch, fnv1a_ch or jump_fnv1a_ch, optionally followed by ,replicas=N, ,diversereplicas=false and ,failover=true")
+	mirrorRouting               = flag.String("mirrorrouting", RoundRobinRouting, "algorithm for distributing messages to the -mirrordestination destinations, like -routing")
+	tertiaryRouting             = flag.String("tertiaryrouting", RoundRobinRouting, "algorithm for distributing messages to the -tertiarydestination destinations, like -routing")
+	reconnectInterval           = flag.Int64("reconnectinterval", ReconnectInterval, "milliseconds before the first attempt to reconnect to a destination that can't be reached")
+	reconnectMaxInterval        = flag.Int64("reconnectmaxinterval", ReconnectMaxInterval, "maximum milliseconds between attempts to reconnect to a destination")
 	cleanupTimeGranularity      = flag.Int64("cleanuptimegranularity", CleanupTimeGranularity, "seconds between cleanup events")
 	cleanupMaxAge               = flag.Int64("cleanupmaxage", CleanupMaxAge, "maximum time in seconds since last message")
 	override                    = flag.String("override", "", "filename for override file")
 	internalMetricPath          = flag.String("internalmetricpath", InternalMetricPath, "go template specifying the path for internal metrics")
+	udpListeningPort            = flag.String("udplisteningport", "", "address for listening to incoming plaintext graphite messages over UDP")
+	udpReadBufferSize           = flag.Int("udpreadbuffersize", UdpReadBufferSize, "size in bytes of the buffer used for reading UDP datagrams")
+	pickleListeningPort         = flag.String("picklelisteningport", "", "address for listening to incoming graphite pickle protocol messages")
+	maxPickleFrameSize          = flag.Int64("maxpickleframesize", MaxPickleFrameSize, "maximum allowed size in bytes of an incoming pickle frame")
+	pickleBatchSize             = flag.Int("picklebatchsize", PickleBatchSize, "default maximum number of metrics in each outgoing pickle batch")
+	pickleMaxBatchLatency       = flag.Int64("picklemaxbatchlatency", PickleMaxBatchLatency, "default maximum time in milliseconds a metric may wait in an outgoing pickle batch")
+	tlsListeningPort            = flag.String("tlslisteningport", "", "address for listening to incoming plaintext graphite messages over TLS")
+	tlsCertFile                 = flag.String("tlscert", "", "PEM file with the certificate for the TLS listener")
+	tlsKeyFile                  = flag.String("tlskey", "", "PEM file with the private key for the TLS listener")
+	tlsCaFile                   = flag.String("tlsca", "", "PEM file with the CA certificates used to verify TLS client certificates")
+	tlsClientAuth               = flag.String("tlsclientauth", TlsClientAuthNone, "verification of TLS client certificates: none, request or require")
+	httpListeningPort           = flag.String("httplisteningport", "", "address for listening to incoming HTTP requests with metrics")
+	httpMaxBodySize             = flag.Int64("httpmaxbodysize", HttpMaxBodySize, "maximum allowed size in bytes of an incoming HTTP request body")
+	statsdListeningPort         = flag.String("statsdlisteningport", "", "address for listening to incoming statsd messages over UDP")
+	statsdFlushInterval         = flag.Int64("statsdflushinterval", StatsdFlushInterval, "seconds between flushes of aggregated statsd metrics")
+	statsdMetricPath            = flag.String("statsdmetricpath", StatsdMetricPath, "go template specifying the path for aggregated statsd metrics")
+	statsdPercentiles           = flag.String("statsdpercentiles", StatsdPercentiles, "comma separated percentiles to calculate for statsd timers")
+	influxListeningPort         = flag.String("influxlisteningport", "", "address for listening to incoming InfluxDB line protocol messages")
+	influxMetricPath            = flag.String("influxmetricpath", InfluxMetricPath, "go template specifying the path for metrics translated from InfluxDB line protocol")
+	influxGraphiteTags          = flag.Bool("influxgraphitetags", InfluxGraphiteTags, "append InfluxDB tags as graphite tags to translated metric paths")
+	influxPrecision             = flag.String("influxprecision", InfluxPrecision, "precision of timestamps received on the InfluxDB listener: ns, us, ms or s")
+	prometheusMetricPath        = flag.String("prometheusmetricpath", PrometheusMetricPath, "go template specifying the path for metrics received with Prometheus remote write")
+	prometheusGraphiteTags      = flag.Bool("prometheusgraphitetags", PrometheusGraphiteTags, "append Prometheus labels as graphite tags to translated metric paths")
+	otlpMetricPath              = flag.String("otlpmetricpath", OtlpMetricPath, "go template specifying the path for metrics received with OTLP/HTTP")
+	otlpGraphiteTags            = flag.Bool("otlpgraphitetags", OtlpGraphiteTags, "append OTLP data point attributes as graphite tags to translated metric paths")
+	otlpResourceTags            = flag.String("otlpresourcetags", OtlpResourceTags, "comma separated OTLP resource or scope attributes to append as graphite tags")
+	listeningPorts              = flag.String("listeningports", "", "additional addresses for listening to incoming plaintext graphite messages, separated by spaces")
+	profilesFile                = flag.String("profiles", "", "filename for policy profile file")
+	proxyProtocol               = flag.Bool("proxyprotocol", false, "expect a PROXY protocol v1 or v2 header on all incoming TCP and unix socket connections")
+	maxLineLength               = flag.Int("maxlinelength", MaxLineLength, "maximum length in bytes of an incoming line. longer lines are discarded. 0 means no limit")
+	idleTimeout                 = flag.Int64("idletimeout", 0, "seconds before an incoming connection without any new lines is closed. 0 means no timeout")
+	readTimeout                 = flag.Int64("readtimeout", 0, "seconds allowed for the rest of a line to arrive once it has begun. 0 means no timeout")
+	maxConnections              = flag.Int("maxconnections", 0, "maximum number of concurrent incoming TCP and unix socket connections. 0 means no limit")
+	tolerantWhitespace          = flag.Bool("tolerantwhitespace", false, "accept tabs and repeated whitespace between the fields of plaintext messages")
+	floatTimestamps             = flag.Bool("floattimestamps", false, "accept fractional timestamps in plaintext messages, which are truncated to whole seconds")
+	allowMissingTimestamp       = flag.Bool("allowmissingtimestamp", false, "accept plaintext messages without a timestamp, which are given the current time")
+	nonFiniteValues             = flag.String("nonfinitevalues", NonFiniteValuesReject, "handling of NaN, +Inf and -Inf values: reject or accept")
+	pathCharacters              = flag.String("pathcharacters", "", "regular expression character class of the characters allowed in metric paths, like a-zA-Z0-9_.-. empty allows all")
+	maxConnectionsPerSource     = flag.Int("maxconnectionspersource", 0, "maximum number of concurrent incoming connections from each source IP address. 0 means no limit")
+	deadLetterFilename          = flag.String("deadletterfile", "", "filename to write rejected and dropped messages to")
+	deadLetterHostPort          = flag.String("deadletterdestination", "", "host:port to send rejected and dropped messages to over TCP")
+	deadLetterMaxSize           = flag.Int64("deadlettermaxsize", DeadLetterMaxSize, "size in bytes at which the dead-letter file is rotated")
+	deadLetterRate              = flag.Int("deadletterrate", DeadLetterRate, "maximum number of dead letters written per second. 0 means no limit")
+	clientStatsTop              = flag.Int("clientstatstop", 0, "number of clients with the most received messages to send per-client statistics for. 0 disables per-client statistics")
+	clientMetricPath            = flag.String("clientmetricpath", "", "go template specifying the path for per-client internal metrics, instead of clients.<client>.<metric> under -internalmetricpath")
+	inputFile                   = flag.String("input", "", "file to read plaintext graphite messages from instead of the listening address, or - for stdin. the process exits at the end of it")
+	inputFollow                 = flag.Bool("inputfollow", false, "keep reading lines appended to the -input file, like tail -F")
+	inputPace                   = flag.Float64("inputpace", 0, "replay -input at the pace of the message timestamps, sped up by this factor. 0 means as fast as possible")
+	spoolDirectory              = flag.String("spooldirectory", "", "directory for the spools of destinations with spool=true")
+	spoolMaxSize                = flag.Int64("spoolmaxsize", SpoolMaxSize, "maximum size in bytes of the spool of each destination. messages are dropped when it is full")
+	spoolSegmentSize            = flag.Int64("spoolsegmentsize", SpoolSegmentSize, "size in bytes at which a new spool segment file is started")
+	spoolReplayRate             = flag.Int("spoolreplayrate", SpoolReplayRate, "maximum number of spooled messages replayed to each destination per second. 0 means no limit")
 )
 
 var timeToCleanup = false
@@ -66,6 +148,14 @@ type metricMessage struct {
 	metricPath string
 	value      float64
 	timestamp  int64
+	messageOrigin
+}
+
+// messageOrigin describes where an incoming message was received from
+type messageOrigin struct {
+	source  string         // Address of the sender, if known
+	client  string         // Subject of the TLS client certificate, if any
+	profile *policyProfile // Profile of the listener, or nil for the default profile
 }
 
 type metricData struct {
@@ -75,12 +165,15 @@ type metricData struct {
 	lastTimestamp    int64
 	consecutiveDry   uint64
 	outputActive     bool
-	allowUnmodified  bool // Pass metric through as-is, no matter what?
+	allowUnmodified  bool           // Pass metric through as-is, no matter what?
+	profile          *policyProfile // Profile of the listener the metric path was first received on
 }
 
 type TemplateData struct {
 	Host   string
 	Metric string
+	Type   string
+	Client string
 }
 
 func main() {
@@ -89,74 +182,224 @@ func main() {
 	nonFlagArgument := os.Args[optind:]
 	flag.Parse()
 
-	if len(nonFlagArgument) < 2 {
-		fmt.Println("Usage: hadrianus listeningport outport1...")
+	// With -input, there's no listening address before the destinations
+	minimumArguments := 2
+	if *inputFile != "" {
+		minimumArguments = 1
+	}
+	if len(nonFlagArgument) < minimumArguments {
+		fmt.Println("Usage: hadrianus listeningaddress outport1...")
+		fmt.Println("       hadrianus -input=filename outport1...")
+		return
+	}
+	if err := validateInputFlags(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+		return
+	}
+	if err := validateSpoolFlags(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+		return
+	}
+	if *pickleBatchSize < 1 || *pickleMaxBatchLatency < 1 {
+		log.Println("-picklebatchsize and -picklemaxbatchlatency must be at least 1")
+		os.Exit(1)
+		return
+	}
+	if *udpReadBufferSize < 1 {
+		log.Println("-udpreadbuffersize must be at least 1")
+		os.Exit(1)
 		return
 	}
 
-	incomingPort := nonFlagArgument[0]
-
-	primaryMetricsOutput := nonFlagArgument[1:]
+	primaryMetricsOutput := nonFlagArgument[minimumArguments-1:]
 
-	var outgoingHostPort [][]string
+	var outgoingHostPort [][]outgoingDestination
+	var outgoingRoutingFlags []string
 
 	// Process and sanity check output cluster arguments
-	err := mungeClusterNodesDestinations(primaryMetricsOutput)
+	primaryDestinations, err := mungeClusterNodesDestinations(primaryMetricsOutput)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 		return
 	}
-	outgoingHostPort = append(outgoingHostPort, primaryMetricsOutput)
+	outgoingHostPort = append(outgoingHostPort, primaryDestinations)
+	outgoingRoutingFlags = append(outgoingRoutingFlags, *routing)
 
 	// Process and sanity check mirror output cluster arguments
 	mirrorNode := strings.Split(*mirrorDestination, " ")
 	if *mirrorDestination != "" {
-		err := mungeClusterNodesDestinations(mirrorNode)
+		mirrorDestinations, err := mungeClusterNodesDestinations(mirrorNode)
 		if err != nil {
 			log.Println(err)
 			os.Exit(1)
 			return
 		}
-		outgoingHostPort = append(outgoingHostPort, mirrorNode)
+		outgoingHostPort = append(outgoingHostPort, mirrorDestinations)
+		outgoingRoutingFlags = append(outgoingRoutingFlags, *mirrorRouting)
 	}
 
 	// Process and sanity check tertiary output cluster arguments
 	tertiaryNode := strings.Split(*tertiaryDestination, " ")
 	if *tertiaryDestination != "" {
-		err := mungeClusterNodesDestinations(tertiaryNode)
+		tertiaryDestinations, err := mungeClusterNodesDestinations(tertiaryNode)
 		if err != nil {
 			log.Println(err)
 			os.Exit(1)
 			return
 		}
-		outgoingHostPort = append(outgoingHostPort, tertiaryNode)
+		outgoingHostPort = append(outgoingHostPort, tertiaryDestinations)
+		outgoingRoutingFlags = append(outgoingRoutingFlags, *tertiaryRouting)
 	}
 
-	// Process and sanity check override file argument
-	var storageSchema map[string]overrideData
+	// Process and sanity check the routing within each output cluster
+	var outgoingRouting []poolRouting
+	for currentPool, routingFlag := range outgoingRoutingFlags {
+		routing, err := parsePoolRouting(routingFlag, outgoingHostPort[currentPool])
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		outgoingRouting = append(outgoingRouting, routing)
+	}
+	if *reconnectInterval < 1 || *reconnectMaxInterval < *reconnectInterval {
+		log.Println("-reconnectmaxinterval must be at least -reconnectinterval, which must be at least 1")
+		os.Exit(1)
+		return
+	}
+
+	// Process and sanity check override file and policy profile arguments
+	defaultProfile := createDefaultPolicyProfile()
+	profiles := map[string]*policyProfile{DefaultProfileName: defaultProfile}
+	if *profilesFile != "" {
+		profiles = getPolicyProfilesFromFile(*profilesFile, defaultProfile)
+	}
 
-	if len(*override) > 0 {
-		storageSchema = getStorageSchemaFromFile(*override)
+	incomingPort, incomingOptions := "", listenerOptions{}
+	if *inputFile == "" {
+		incomingPort, incomingOptions, err = parseListenerOptions(nonFlagArgument[0], profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+	}
+	var additionalListeners []string
+	var additionalListenerOptions []listenerOptions
+	for _, listenAddress := range strings.Fields(*listeningPorts) {
+		additionalPort, additionalOptions, err := parseListenerOptions(listenAddress, profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		additionalListeners = append(additionalListeners, additionalPort)
+		additionalListenerOptions = append(additionalListenerOptions, additionalOptions)
 	}
 
-	// Automatically whitelist internal hadrianus metrics
-	if len(storageSchema) == 0 {
-		storageSchema = make(map[string]overrideData)
+	if err := initializeValidationPolicy(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+		return
 	}
-	internalHadrianusPattern, _ := regexp.Compile(`^server\.hadrianus\.`)
-	storageSchema[`hadrianus`] = overrideData{pattern: internalHadrianusPattern, allowUnmodifiedActive: true, allowUnmodified: true}
 
 	initializeInternalMetricsPaths(*internalMetricPath)
+	initializeClientStats()
+	createDeadLetterSink()
 
 	incomingMessageChannel := make(chan metricMessage, IncomingChannelSize)
 	outgoingToPoolChannel := make(chan metricMessage, PoolChannelSize)
 
-	// Create listening socket
-	go createIncomingConnections(incomingPort, incomingMessageChannel)
+	// Create listening socket, or read the input instead. inputDone stays nil unless there is an input.
+	var inputDone chan struct{}
+	if *inputFile != "" {
+		inputDone = createInputReader(incomingMessageChannel)
+	} else {
+		go createIncomingConnections(incomingPort, incomingMessageChannel, incomingOptions.handleIncomingConnection)
+	}
+	for i, additionalPort := range additionalListeners {
+		go createIncomingConnections(additionalPort, incomingMessageChannel, additionalListenerOptions[i].handleIncomingConnection)
+	}
+	if *tlsListeningPort != "" {
+		tlsPort, tlsOptions, err := parseListenerOptions(*tlsListeningPort, profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		tlsConfig, err := createListenerTlsConfig()
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		go createIncomingTlsConnections(tlsPort, tlsConfig, incomingMessageChannel, tlsOptions.handleIncomingConnection)
+	}
+	if *influxListeningPort != "" {
+		influxPort, influxProfile, err := parseProfileListenerOptions(*influxListeningPort, profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		influx := createInfluxConverter()
+		go createIncomingConnections(influxPort, incomingMessageChannel, func(connection net.Conn, incomingMessageChannel chan metricMessage) {
+			influx.handleIncomingConnection(connection, influxProfile, incomingMessageChannel)
+		})
+	}
+	if *httpListeningPort != "" {
+		httpPort, httpProfile, err := parseProfileListenerOptions(*httpListeningPort, profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		go createHttpListener(httpPort, httpProfile, incomingMessageChannel)
+	}
+	if *pickleListeningPort != "" {
+		picklePort, pickleProfile, err := parseProfileListenerOptions(*pickleListeningPort, profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		go createIncomingConnections(picklePort, incomingMessageChannel, func(connection net.Conn, incomingMessageChannel chan metricMessage) {
+			handleIncomingPickleConnection(connection, pickleProfile, incomingMessageChannel)
+		})
+	}
+	if *udpListeningPort != "" {
+		udpPort, udpProfile, err := parseProfileListenerOptions(*udpListeningPort, profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		udpCounters := datagramCounters{received: UdpDatagramReceived, truncated: UdpDatagramTruncated, readError: UdpReadError}
+		go createIncomingUdpListener(udpPort, udpCounters, func(line string, source string) {
+			processIncomingLine(line, messageOrigin{source: source, profile: udpProfile}, incomingMessageChannel)
+		})
+	}
+	if *statsdListeningPort != "" {
+		statsdPort, statsdProfile, err := parseProfileListenerOptions(*statsdListeningPort, profiles)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+			return
+		}
+		if *statsdFlushInterval < 1 || *statsdFlushInterval < statsdProfile.minimumTimeInterval {
+			log.Println("-statsdflushinterval must be at least 1, and at least the minimumtimeinterval of the statsd listener's profile")
+			os.Exit(1)
+			return
+		}
+		go createStatsdListener(statsdPort, statsdProfile, incomingMessageChannel)
+	}
 
 	// Create outgoing pool
-	go handleOutgoingPool(outgoingToPoolChannel, outgoingHostPort)
+	outputsDrained := make(chan struct{})
+	go handleOutgoingPool(outgoingToPoolChannel, outgoingHostPort, outgoingRouting, outputsDrained)
 
 	metric := make(map[string]*metricData)
 
@@ -180,6 +423,7 @@ func main() {
 
 			// Trigger generation of stats for counters
 			generateInternalStats(incomingMessageChannel)
+			generateClientStats(incomingMessageChannel)
 		}
 	}()
 
@@ -193,7 +437,21 @@ func main() {
 
 	// Main loop
 	for {
-		fromConnection := <-incomingMessageChannel
+		var fromConnection metricMessage
+		select {
+		case fromConnection = <-incomingMessageChannel:
+		case <-inputDone:
+			// Process the messages that were read before the end of the input, then wait for them to be sent
+			if len(incomingMessageChannel) > 0 {
+				continue
+			}
+			close(outgoingToPoolChannel)
+			<-outputsDrained
+			waitForDeadLetters()
+			log.Println("Finished reading", *inputFile+":", counterData[ReceivedMessage], "received,", counterData[InvalidMessage], "invalid and", counterData[SentMessage], "sent messages")
+			return
+		}
+		countClientMessage(fromConnection.messageOrigin, ClientReceivedMessage)
 
 		var instance *metricData
 		var found bool
@@ -202,23 +460,29 @@ func main() {
 		if instance, found = metric[fromConnection.metricPath]; !found {
 			gaugeData[EncounteredMetricPaths]++
 
+			profile := fromConnection.profile
+			if profile == nil {
+				profile = defaultProfile
+			}
+
 			// Initialize data for newly discovered metric
 			instance = &metricData{
-				outputActive:     *isNewMetricEnabledByDefault,
+				outputActive:     profile.isNewMetricEnabledByDefault,
 				unchangedCounter: 0,
 				lastValue:        fromConnection.value,
-				lastSentOut:      fromConnection.timestamp - *minimumTimeInterval,
+				lastSentOut:      fromConnection.timestamp - profile.minimumTimeInterval,
 				lastTimestamp:    fromConnection.timestamp,
 				allowUnmodified:  false,
-				consecutiveDry:   *maxConsecutiveDryMessages,
+				consecutiveDry:   profile.maxConsecutiveDryMessages,
+				profile:          profile,
 			}
-			if !*isNewMetricEnabledByDefault {
+			if !profile.isNewMetricEnabledByDefault {
 				gaugeData[StaleMetricPaths]++
 			}
 
 			// Check if the newly discovered metric path matches patterns in the override file
-			for _, value := range storageSchema {
-				if value.pattern.Match([]byte(fromConnection.metricPath)) {
+			for _, value := range profile.storageSchema {
+				if value.matches(fromConnection.metricPath, fromConnection.client) {
 					if value.retentionActive {
 						// Do nothing. Not yet implemented.
 					}
@@ -239,6 +503,7 @@ func main() {
 			writeToOutPool(outgoingToPoolChannel, fromConnection)
 			instance.lastSentOut = fromConnection.timestamp
 			counterData[SentMessage]++
+			countClientMessage(fromConnection.messageOrigin, ClientSentMessage)
 		} else {
 			// Check that the metric value hasn't gone stale
 			if fromConnection.value == instance.lastValue {
@@ -259,13 +524,13 @@ func main() {
 					instance.outputActive = true
 					gaugeData[StaleMetricPaths]--
 					// Send out previous "silenced" metric to make data nicer
-					writeToOutPool(outgoingToPoolChannel, metricMessage{fromConnection.metricPath, instance.lastValue, instance.lastTimestamp})
+					writeToOutPool(outgoingToPoolChannel, metricMessage{metricPath: fromConnection.metricPath, value: instance.lastValue, timestamp: instance.lastTimestamp})
 				}
 				instance.unchangedCounter = 0
 			}
 
 			// Check that the metric doesn't come in too often
-			chatty := fromConnection.timestamp < (instance.lastSentOut + *minimumTimeInterval)
+			chatty := fromConnection.timestamp < (instance.lastSentOut + instance.profile.minimumTimeInterval)
 
 			// Allow resending of stale metric periodically to keep it "alive"
 			timeToResendStaleMessage := *staleResendInterval > 0 && fromConnection.timestamp > (instance.lastSentOut+*staleResendInterval)
@@ -275,12 +540,16 @@ func main() {
 				writeToOutPool(outgoingToPoolChannel, fromConnection)
 				instance.lastSentOut = fromConnection.timestamp
 				counterData[SentMessage]++
+				countClientMessage(fromConnection.messageOrigin, ClientSentMessage)
 			} else if !instance.outputActive && chatty {
 				counterData[DiscardedStaleAndChattyMessage]++
+				countClientMessage(fromConnection.messageOrigin, ClientDiscardedStaleMessage)
 			} else if !instance.outputActive && !chatty {
 				counterData[DiscardedStaleMessage]++
+				countClientMessage(fromConnection.messageOrigin, ClientDiscardedStaleMessage)
 			} else if instance.outputActive && chatty {
 				counterData[DiscardedChattyMessage]++
+				countClientMessage(fromConnection.messageOrigin, ClientDiscardedChattyMessage)
 			}
 		}
 		instance.lastValue = fromConnection.value
@@ -307,33 +576,43 @@ func main() {
 	}
 }
 
+// parseGraphiteMessage parses "metric_path value timestamp" according to the validation policy flags.
+// A timestamp of -1 means the current time, just like in carbon.
 func parseGraphiteMessage(graphiteMessage string) (metricMessage, error) {
 	var outputMessage metricMessage
 	var err error
-	splitString := strings.Split(graphiteMessage, " ")
+	var splitString []string
+	if *tolerantWhitespace {
+		splitString = strings.Fields(graphiteMessage)
+	} else {
+		splitString = strings.Split(graphiteMessage, " ")
+	}
+	if len(splitString) == 2 && *allowMissingTimestamp {
+		splitString = append(splitString, "-1")
+	}
 	if len(splitString) != 3 {
-		return outputMessage, errors.New("Wrong number of fields in graphite message: " + graphiteMessage)
+		return outputMessage, invalidMessageError{InvalidMessageFieldCount, "Wrong number of fields in graphite message: " + graphiteMessage}
 	}
 	if len(splitString[0]) < 1 {
-		return outputMessage, errors.New("Length of metric_path too short (0) in graphite message: " + graphiteMessage)
-	}
-	outputMessage.metricPath = splitString[0]
-	if splitString[1] == "NaN" {
-		return outputMessage, errors.New("Invalid value field in graphite message: " + graphiteMessage)
+		return outputMessage, invalidMessageError{InvalidMessageEmptyPath, "Length of metric_path too short (0) in graphite message: " + graphiteMessage}
 	}
-	if splitString[1] == "-Inf" {
-		return outputMessage, errors.New("Invalid value field in graphite message: " + graphiteMessage)
+	if outputMessage.metricPath, err = normalizeMetricPath(splitString[0]); err != nil {
+		return outputMessage, invalidMessageError{InvalidMessageTags, "Invalid tags in graphite message: " + graphiteMessage}
 	}
 	if outputMessage.value, err = strconv.ParseFloat(splitString[1], 64); err != nil {
-		return outputMessage, errors.New("Invalid value field in graphite message: " + graphiteMessage)
+		return outputMessage, invalidMessageError{InvalidMessageValue, "Invalid value field in graphite message: " + graphiteMessage}
 	}
 	if outputMessage.timestamp, err = strconv.ParseInt(splitString[2], 10, 64); err != nil {
-		return outputMessage, errors.New("Invalid timestamp field in graphite message: " + graphiteMessage)
+		floatTimestamp, floatErr := strconv.ParseFloat(splitString[2], 64)
+		if !*floatTimestamps || floatErr != nil || math.IsNaN(floatTimestamp) || floatTimestamp >= math.MaxInt64 || floatTimestamp < math.MinInt64 {
+			return outputMessage, invalidMessageError{InvalidMessageTimestamp, "Invalid timestamp field in graphite message: " + graphiteMessage}
+		}
+		outputMessage.timestamp = int64(floatTimestamp)
 	}
 	if outputMessage.timestamp == -1 {
 		outputMessage.timestamp = time.Now().Unix()
 	}
-	return outputMessage, err
+	return outputMessage, validateMetricMessage(outputMessage, "graphite message: "+graphiteMessage)
 }
 
 // permutateArgs permutates args such that options are in front,
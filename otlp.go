@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path of the OTLP/HTTP metrics endpoint
+const OtlpHttpPath = "/v1/metrics"
+
+// The OTLP structures below only contain what's needed to flatten gauges, sums and histograms.
+// They can be decoded both from the OTLP JSON encoding and, using decodeOtlpRequest, from protobuf.
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope struct {
+		Name       string         `json:"name"`
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name                 string             `json:"name"`
+	Gauge                *otlpNumberData    `json:"gauge"`
+	Sum                  *otlpNumberData    `json:"sum"`
+	Histogram            *otlpHistogramData `json:"histogram"`
+	ExponentialHistogram *json.RawMessage   `json:"exponentialHistogram"`
+	Summary              *json.RawMessage   `json:"summary"`
+	unsupported          bool               // Set by the protobuf decoder for exponential histograms and summaries
+}
+
+type otlpNumberData struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes   []otlpKeyValue `json:"attributes"`
+	TimeUnixNano otlpNumber     `json:"timeUnixNano"`
+	AsDouble     *otlpNumber    `json:"asDouble"`
+	AsInt        *otlpNumber    `json:"asInt"`
+}
+
+type otlpHistogramData struct {
+	DataPoints []otlpHistogramDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes     []otlpKeyValue `json:"attributes"`
+	TimeUnixNano   otlpNumber     `json:"timeUnixNano"`
+	Count          otlpNumber     `json:"count"`
+	Sum            *otlpNumber    `json:"sum"`
+	BucketCounts   []otlpNumber   `json:"bucketCounts"`
+	ExplicitBounds []otlpNumber   `json:"explicitBounds"`
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string     `json:"stringValue"`
+		BoolValue   *bool       `json:"boolValue"`
+		IntValue    *otlpNumber `json:"intValue"`
+		DoubleValue *otlpNumber `json:"doubleValue"`
+	} `json:"value"`
+}
+
+// otlpNumber accepts both JSON numbers and the quoted numbers, "NaN" and "Infinity" that the OTLP JSON encoding uses
+type otlpNumber float64
+
+func (number *otlpNumber) UnmarshalJSON(data []byte) error {
+	value, err := strconv.ParseFloat(strings.Trim(string(data), `"`), 64)
+	*number = otlpNumber(value)
+	return err
+}
+
+type otlpTemplateData struct {
+	Name       string
+	Resource   map[string]string
+	ScopeName  string
+	Scope      map[string]string
+	Attributes map[string]string
+}
+
+// otlpConverter flattens OTLP metrics into graphite messages
+type otlpConverter struct {
+	metricPathTemplate *template.Template
+	graphiteTags       bool     // Append the data point attributes as graphite tags
+	resourceTags       []string // Resource or scope attributes to append as graphite tags
+}
+
+func newOtlpConverter(metricPathTemplate string, graphiteTags bool, resourceTagsText string) (*otlpConverter, error) {
+	parsedTemplate, err := template.New("otlpMetricPath").Parse(metricPathTemplate)
+	if err != nil {
+		return nil, err
+	}
+	converter := &otlpConverter{metricPathTemplate: parsedTemplate, graphiteTags: graphiteTags}
+	for _, resourceTag := range strings.Split(resourceTagsText, ",") {
+		if strings.TrimSpace(resourceTag) != "" {
+			converter.resourceTags = append(converter.resourceTags, strings.TrimSpace(resourceTag))
+		}
+	}
+	return converter, nil
+}
+
+// convertRequest flattens gauges and sums into one metric per data point, and histograms into
+// <path>.count, <path>.sum and one <path>.bucket.le_<bound> per bucket. It returns the rejected
+// data points, and metrics of unsupported types count as one rejected data point each.
+func (converter *otlpConverter) convertRequest(request otlpExportRequest) ([]metricMessage, []rejectedMessage) {
+	var outputMessages []metricMessage
+	var rejected []rejectedMessage
+	reject := func(reason CounterId, line string) {
+		rejected = append(rejected, rejectedMessage{reason, line})
+	}
+	for _, resourceMetrics := range request.ResourceMetrics {
+		resource := otlpAttributesToMap(resourceMetrics.Resource.Attributes)
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			templateData := otlpTemplateData{Resource: resource, ScopeName: sanitizePathComponent(scopeMetrics.Scope.Name), Scope: otlpAttributesToMap(scopeMetrics.Scope.Attributes)}
+			for _, metric := range scopeMetrics.Metrics {
+				templateData.Name = sanitizePathComponent(metric.Name)
+				var numberData *otlpNumberData
+				switch {
+				case metric.Gauge != nil:
+					numberData = metric.Gauge
+				case metric.Sum != nil:
+					numberData = metric.Sum
+				case metric.Histogram != nil:
+					for _, dataPoint := range metric.Histogram.DataPoints {
+						templateData.Attributes = otlpAttributesToMap(dataPoint.Attributes)
+						histogramMessages, err := converter.convertHistogramDataPoint(templateData, dataPoint)
+						if err != nil {
+							reason := OtlpRejectedDataPoint
+							var invalidMessage invalidMessageError
+							if errors.As(err, &invalidMessage) {
+								reason = countInvalidMessage(err)
+							}
+							reject(reason, metric.Name+": "+err.Error())
+							continue
+						}
+						outputMessages = append(outputMessages, histogramMessages...)
+					}
+					continue
+				default:
+					reject(OtlpRejectedDataPoint, metric.Name+": Unsupported metric type")
+					continue
+				}
+
+				for _, dataPoint := range numberData.DataPoints {
+					templateData.Attributes = otlpAttributesToMap(dataPoint.Attributes)
+					var value float64
+					switch {
+					case dataPoint.AsDouble != nil:
+						value = float64(*dataPoint.AsDouble)
+					case dataPoint.AsInt != nil:
+						value = float64(*dataPoint.AsInt)
+					default:
+						reject(OtlpRejectedDataPoint, metric.Name+": Data point without a value")
+						continue
+					}
+					metricPath, err := converter.metricPath(templateData, "")
+					if err != nil {
+						reject(OtlpRejectedDataPoint, metric.Name+": "+err.Error())
+						continue
+					}
+					outputMessage := metricMessage{metricPath: metricPath, value: value, timestamp: otlpTimestamp(dataPoint.TimeUnixNano)}
+					if err := validateMetricMessage(outputMessage, "OTLP data point"); err != nil {
+						reject(countInvalidMessage(err), fmt.Sprint(metricPath, " ", value, " ", outputMessage.timestamp))
+						continue
+					}
+					outputMessages = append(outputMessages, outputMessage)
+				}
+			}
+		}
+	}
+	return outputMessages, rejected
+}
+
+func (converter *otlpConverter) convertHistogramDataPoint(templateData otlpTemplateData, dataPoint otlpHistogramDataPoint) ([]metricMessage, error) {
+	timestamp := otlpTimestamp(dataPoint.TimeUnixNano)
+	var outputMessages []metricMessage
+	add := func(suffix string, value float64) error {
+		metricPath, err := converter.metricPath(templateData, suffix)
+		if err != nil {
+			return err
+		}
+		outputMessage := metricMessage{metricPath: metricPath, value: value, timestamp: timestamp}
+		if err := validateMetricMessage(outputMessage, "OTLP histogram data point: "+metricPath); err != nil {
+			return err
+		}
+		outputMessages = append(outputMessages, outputMessage)
+		return nil
+	}
+
+	if err := add(".count", float64(dataPoint.Count)); err != nil {
+		return nil, err
+	}
+	if dataPoint.Sum != nil && !math.IsNaN(float64(*dataPoint.Sum)) {
+		if err := add(".sum", float64(*dataPoint.Sum)); err != nil {
+			return nil, err
+		}
+	}
+	// There is one more bucket than there are bounds, and the last one has no upper bound
+	if len(dataPoint.BucketCounts) > 0 && len(dataPoint.BucketCounts) != len(dataPoint.ExplicitBounds)+1 {
+		return nil, errors.New("Mismatching histogram buckets and bounds")
+	}
+	for i, bucketCount := range dataPoint.BucketCounts {
+		bound := "inf"
+		if i < len(dataPoint.ExplicitBounds) {
+			bound = strings.ReplaceAll(strconv.FormatFloat(float64(dataPoint.ExplicitBounds[i]), 'f', -1, 64), ".", "_")
+		}
+		if err := add(".bucket.le_"+bound, float64(bucketCount)); err != nil {
+			return nil, err
+		}
+	}
+	return outputMessages, nil
+}
+
+// metricPath renders the template, adds the suffix and, if enabled, appends the data point attributes
+// and the configured resource or scope attributes as graphite tags
+func (converter *otlpConverter) metricPath(templateData otlpTemplateData, suffix string) (string, error) {
+	var templateOutputBuffer bytes.Buffer
+	if err := converter.metricPathTemplate.Execute(&templateOutputBuffer, templateData); err != nil {
+		return "", err
+	}
+	metricPath := removeEmptyPathComponents(templateOutputBuffer.String() + suffix)
+	if metricPath == "" {
+		return "", errors.New("OTLP metric path template rendered an empty path")
+	}
+	if converter.graphiteTags {
+		tags := make(map[string]string, len(templateData.Attributes)+len(converter.resourceTags))
+		for _, resourceTag := range converter.resourceTags {
+			if value, ok := templateData.Resource[resourceTag]; ok {
+				tags[resourceTag] = value
+			} else if value, ok := templateData.Scope[resourceTag]; ok {
+				tags[resourceTag] = value
+			}
+		}
+		for key, value := range templateData.Attributes {
+			tags[key] = value
+		}
+		metricPath = appendGraphiteTags(metricPath, tags)
+	}
+	return normalizeMetricPath(metricPath)
+}
+
+// otlpAttributesToMap converts scalar attributes to sanitized strings. Arrays, maps and bytes are skipped.
+func otlpAttributesToMap(attributes []otlpKeyValue) map[string]string {
+	attributeMap := make(map[string]string, len(attributes))
+	for _, attribute := range attributes {
+		var value string
+		switch {
+		case attribute.Value.StringValue != nil:
+			value = *attribute.Value.StringValue
+		case attribute.Value.BoolValue != nil:
+			value = strconv.FormatBool(*attribute.Value.BoolValue)
+		case attribute.Value.IntValue != nil:
+			value = strconv.FormatInt(int64(*attribute.Value.IntValue), 10)
+		case attribute.Value.DoubleValue != nil:
+			value = strconv.FormatFloat(float64(*attribute.Value.DoubleValue), 'f', -1, 64)
+		}
+		if attribute.Key != "" && value != "" {
+			attributeMap[sanitizePathComponent(attribute.Key)] = sanitizePathComponent(value)
+		}
+	}
+	return attributeMap
+}
+
+// otlpTimestamp converts nanoseconds to seconds. Data points without a timestamp are given the current time.
+func otlpTimestamp(timeUnixNano otlpNumber) int64 {
+	if timeUnixNano <= 0 {
+		return time.Now().Unix()
+	}
+	return int64(float64(timeUnixNano) / float64(time.Second))
+}
+
+// decodeOtlpRequest decodes a protobuf ExportMetricsServiceRequest
+func decodeOtlpRequest(data []byte) (otlpExportRequest, error) {
+	var request otlpExportRequest
+	err := forEachProtobufMessage(&protobufReader{data: data}, func(fieldNumber int, reader *protobufReader) error {
+		if fieldNumber != 1 {
+			return nil
+		}
+		var resourceMetrics otlpResourceMetrics
+		err := forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+			switch fieldNumber {
+			case 1:
+				return forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+					return appendOtlpAttribute(&resourceMetrics.Resource.Attributes, fieldNumber, 1, reader)
+				})
+			case 2:
+				scopeMetrics, err := decodeOtlpScopeMetrics(reader)
+				resourceMetrics.ScopeMetrics = append(resourceMetrics.ScopeMetrics, scopeMetrics)
+				return err
+			}
+			return nil
+		})
+		request.ResourceMetrics = append(request.ResourceMetrics, resourceMetrics)
+		return err
+	})
+	return request, err
+}
+
+func decodeOtlpScopeMetrics(reader *protobufReader) (otlpScopeMetrics, error) {
+	var scopeMetrics otlpScopeMetrics
+	err := forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+		switch fieldNumber {
+		case 1:
+			return forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+				if fieldNumber == 1 {
+					scopeMetrics.Scope.Name = string(reader.data)
+					return nil
+				}
+				return appendOtlpAttribute(&scopeMetrics.Scope.Attributes, fieldNumber, 3, reader)
+			})
+		case 2:
+			metric, err := decodeOtlpMetric(reader)
+			scopeMetrics.Metrics = append(scopeMetrics.Metrics, metric)
+			return err
+		}
+		return nil
+	})
+	return scopeMetrics, err
+}
+
+func decodeOtlpMetric(reader *protobufReader) (otlpMetric, error) {
+	var metric otlpMetric
+	err := forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+		switch fieldNumber {
+		case 1:
+			metric.Name = string(reader.data)
+		case 5, 7:
+			numberData := &otlpNumberData{}
+			if fieldNumber == 5 {
+				metric.Gauge = numberData
+			} else {
+				metric.Sum = numberData
+			}
+			return forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+				if fieldNumber != 1 {
+					return nil
+				}
+				dataPoint, err := decodeOtlpNumberDataPoint(reader)
+				numberData.DataPoints = append(numberData.DataPoints, dataPoint)
+				return err
+			})
+		case 9:
+			metric.Histogram = &otlpHistogramData{}
+			return forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+				if fieldNumber != 1 {
+					return nil
+				}
+				dataPoint, err := decodeOtlpHistogramDataPoint(reader)
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, dataPoint)
+				return err
+			})
+		case 10, 11:
+			metric.unsupported = true
+		}
+		return nil
+	})
+	if metric.unsupported {
+		metric.Gauge, metric.Sum, metric.Histogram = nil, nil, nil
+	}
+	return metric, err
+}
+
+func decodeOtlpNumberDataPoint(reader *protobufReader) (otlpNumberDataPoint, error) {
+	var dataPoint otlpNumberDataPoint
+	for !reader.done() {
+		fieldNumber, wireType, err := reader.next()
+		if err != nil {
+			return dataPoint, err
+		}
+		switch {
+		case fieldNumber == 3 && wireType == ProtobufFixed64:
+			var timeUnixNano uint64
+			timeUnixNano, err = reader.fixed64()
+			dataPoint.TimeUnixNano = otlpNumber(timeUnixNano)
+		case fieldNumber == 4 && wireType == ProtobufFixed64:
+			var value float64
+			value, err = reader.double()
+			dataPoint.AsDouble = (*otlpNumber)(&value)
+		case fieldNumber == 6 && wireType == ProtobufFixed64:
+			var value uint64
+			value, err = reader.fixed64()
+			intValue := otlpNumber(int64(value))
+			dataPoint.AsInt = &intValue
+		case fieldNumber == 7 && wireType == ProtobufLengthDelimited:
+			var attribute *protobufReader
+			if attribute, err = reader.message(); err == nil {
+				err = appendOtlpAttribute(&dataPoint.Attributes, 1, 1, attribute)
+			}
+		default:
+			err = reader.skip(wireType)
+		}
+		if err != nil {
+			return dataPoint, err
+		}
+	}
+	return dataPoint, nil
+}
+
+func decodeOtlpHistogramDataPoint(reader *protobufReader) (otlpHistogramDataPoint, error) {
+	var dataPoint otlpHistogramDataPoint
+	for !reader.done() {
+		fieldNumber, wireType, err := reader.next()
+		if err != nil {
+			return dataPoint, err
+		}
+		switch {
+		case fieldNumber == 3 && wireType == ProtobufFixed64:
+			var timeUnixNano uint64
+			timeUnixNano, err = reader.fixed64()
+			dataPoint.TimeUnixNano = otlpNumber(timeUnixNano)
+		case fieldNumber == 4 && wireType == ProtobufFixed64:
+			var count uint64
+			count, err = reader.fixed64()
+			dataPoint.Count = otlpNumber(count)
+		case fieldNumber == 5 && wireType == ProtobufFixed64:
+			var sum float64
+			sum, err = reader.double()
+			dataPoint.Sum = (*otlpNumber)(&sum)
+		case fieldNumber == 6 || fieldNumber == 7:
+			// Repeated fixed64 and double fields are usually packed, but may also be sent one by one
+			var values []uint64
+			if values, err = readProtobufRepeatedFixed64(reader, wireType); err != nil {
+				break
+			}
+			for _, value := range values {
+				if fieldNumber == 6 {
+					dataPoint.BucketCounts = append(dataPoint.BucketCounts, otlpNumber(value))
+				} else {
+					dataPoint.ExplicitBounds = append(dataPoint.ExplicitBounds, otlpNumber(math.Float64frombits(value)))
+				}
+			}
+		case fieldNumber == 9 && wireType == ProtobufLengthDelimited:
+			var attribute *protobufReader
+			if attribute, err = reader.message(); err == nil {
+				err = appendOtlpAttribute(&dataPoint.Attributes, 1, 1, attribute)
+			}
+		default:
+			err = reader.skip(wireType)
+		}
+		if err != nil {
+			return dataPoint, err
+		}
+	}
+	return dataPoint, nil
+}
+
+func readProtobufRepeatedFixed64(reader *protobufReader, wireType int) ([]uint64, error) {
+	if wireType == ProtobufFixed64 {
+		value, err := reader.fixed64()
+		return []uint64{value}, err
+	}
+	if wireType != ProtobufLengthDelimited {
+		return nil, reader.skip(wireType)
+	}
+	packed, err := reader.bytes()
+	if err != nil || len(packed)%8 != 0 {
+		return nil, errProtobufTruncated
+	}
+	values := make([]uint64, 0, len(packed)/8)
+	for i := 0; i < len(packed); i += 8 {
+		values = append(values, binary.LittleEndian.Uint64(packed[i:]))
+	}
+	return values, nil
+}
+
+// appendOtlpAttribute decodes a KeyValue, if fieldNumber is the field that holds attributes
+func appendOtlpAttribute(attributes *[]otlpKeyValue, fieldNumber int, attributesFieldNumber int, reader *protobufReader) error {
+	if fieldNumber != attributesFieldNumber {
+		return nil
+	}
+	var attribute otlpKeyValue
+	err := forEachProtobufMessage(reader, func(fieldNumber int, reader *protobufReader) error {
+		if fieldNumber == 1 {
+			attribute.Key = string(reader.data)
+			return nil
+		}
+		if fieldNumber != 2 {
+			return nil
+		}
+		// AnyValue, where only the scalar types are kept
+		for !reader.done() {
+			valueField, wireType, err := reader.next()
+			if err != nil {
+				return err
+			}
+			switch {
+			case valueField == 1 && wireType == ProtobufLengthDelimited:
+				var stringValue string
+				stringValue, err = reader.string()
+				attribute.Value.StringValue = &stringValue
+			case valueField == 2 && wireType == ProtobufVarint:
+				var boolValue uint64
+				boolValue, err = reader.varint()
+				isTrue := boolValue != 0
+				attribute.Value.BoolValue = &isTrue
+			case valueField == 3 && wireType == ProtobufVarint:
+				var intValue uint64
+				intValue, err = reader.varint()
+				number := otlpNumber(int64(intValue))
+				attribute.Value.IntValue = &number
+			case valueField == 4 && wireType == ProtobufFixed64:
+				var doubleValue float64
+				doubleValue, err = reader.double()
+				attribute.Value.DoubleValue = (*otlpNumber)(&doubleValue)
+			default:
+				err = reader.skip(wireType)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	*attributes = append(*attributes, attribute)
+	return err
+}
+
+// forEachProtobufMessage calls messageHandler with each length-delimited field, skipping all other fields
+func forEachProtobufMessage(reader *protobufReader, messageHandler func(int, *protobufReader) error) error {
+	for !reader.done() {
+		fieldNumber, wireType, err := reader.next()
+		if err != nil {
+			return err
+		}
+		if wireType != ProtobufLengthDelimited {
+			if err = reader.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		message, err := reader.message()
+		if err != nil {
+			return err
+		}
+		if err = messageHandler(fieldNumber, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleHttpRequest implements an OTLP/HTTP metrics receiver, for both the protobuf and JSON encodings
+func (converter *otlpConverter) handleHttpRequest(responseWriter http.ResponseWriter, request *http.Request, origin messageOrigin, incomingMessageChannel chan metricMessage) {
+	if !acceptHttpPost(responseWriter, request) {
+		return
+	}
+	var body io.Reader = request.Body
+	if request.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			counterData[HttpRequestRejected]++
+			http.Error(responseWriter, "Invalid gzip body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The decompressed body has the same limit, so that a small gzip body can't expand without bounds
+		body = http.MaxBytesReader(responseWriter, io.NopCloser(gzipReader), *httpMaxBodySize)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		counterData[HttpRequestRejected]++
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			http.Error(responseWriter, "Body is larger than -httpmaxbodysize", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(responseWriter, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	isJson := strings.HasPrefix(request.Header.Get("Content-Type"), "application/json")
+	var exportRequest otlpExportRequest
+	if isJson {
+		err = json.Unmarshal(data, &exportRequest)
+	} else {
+		exportRequest, err = decodeOtlpRequest(data)
+	}
+	if err != nil {
+		counterData[HttpRequestRejected]++
+		http.Error(responseWriter, "Invalid OTLP body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	incomingMessages, rejectedDataPoints := converter.convertRequest(exportRequest)
+	recordRejectedMessages(rejectedDataPoints, origin)
+	rejected := len(rejectedDataPoints)
+	counterData[OtlpReceivedMetric] += int64(len(incomingMessages))
+	counterData[OtlpRejectedDataPoint] += int64(rejected)
+	for _, incomingMessage := range incomingMessages {
+		incomingMessage.messageOrigin = origin
+		writeIncomingMessage(incomingMessageChannel, incomingMessage)
+	}
+
+	// Reply with an ExportMetricsServiceResponse, including partial_success if anything was rejected
+	errorMessage := "unsupported metric types or invalid data points"
+	if isJson {
+		responseWriter.Header().Set("Content-Type", "application/json")
+		response := map[string]interface{}{}
+		if rejected > 0 {
+			response["partialSuccess"] = map[string]interface{}{"rejectedDataPoints": strconv.Itoa(rejected), "errorMessage": errorMessage}
+		}
+		json.NewEncoder(responseWriter).Encode(response)
+		return
+	}
+	responseWriter.Header().Set("Content-Type", "application/x-protobuf")
+	if rejected > 0 {
+		partialSuccess := append([]byte{1 << 3}, binary.AppendUvarint(nil, uint64(rejected))...)
+		partialSuccess = append(partialSuccess, 2<<3|ProtobufLengthDelimited, byte(len(errorMessage)))
+		partialSuccess = append(partialSuccess, errorMessage...)
+		responseWriter.Write(append([]byte{1<<3 | ProtobufLengthDelimited, byte(len(partialSuccess))}, partialSuccess...))
+	}
+}
+
+func createOtlpConverter() *otlpConverter {
+	converter, err := newOtlpConverter(*otlpMetricPath, *otlpGraphiteTags, *otlpResourceTags)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	return converter
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A request with a gauge, a sum, a histogram and a summary, in the OTLP JSON encoding
+const otlpJsonFixture = `{"resourceMetrics": [{
+	"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "api"}}, {"key": "host.name", "value": {"stringValue": "web01"}}]},
+	"scopeMetrics": [{
+		"scope": {"name": "io.test"},
+		"metrics": [
+			{"name": "system.cpu.utilization", "gauge": {"dataPoints": [
+				{"attributes": [{"key": "cpu", "value": {"intValue": "0"}}], "timeUnixNano": "1700000000500000000", "asDouble": 0.25}
+			]}},
+			{"name": "http.requests", "sum": {"aggregationTemporality": 2, "isMonotonic": true, "dataPoints": [
+				{"attributes": [{"key": "http.method", "value": {"stringValue": "GET"}}], "timeUnixNano": "1700000000000000000", "asInt": "5"}
+			]}},
+			{"name": "http.duration", "histogram": {"aggregationTemporality": 2, "dataPoints": [
+				{"timeUnixNano": "1700000000000000000", "count": "3", "sum": 0.7, "bucketCounts": ["1", "2", "0"], "explicitBounds": [0.1, 0.5]}
+			]}},
+			{"name": "rpc.latency", "summary": {"dataPoints": [
+				{"timeUnixNano": "1700000000000000000", "count": "3", "sum": 0.7, "quantileValues": [{"quantile": 0.5, "value": 0.2}]}
+			]}}
+		]
+	}]
+}]}`
+
+// The same request in the protobuf encoding, with the fields that aren't used in between
+func otlpProtobufFixture() []byte {
+	attribute := func(fieldNumber int, key string, value []byte) []byte {
+		return protobufMessageField(fieldNumber, protobufStringField(1, key), protobufMessageField(2, value))
+	}
+	packedFixed64 := func(fieldNumber int, values ...uint64) []byte {
+		var data []byte
+		for _, value := range values {
+			data = binary.LittleEndian.AppendUint64(data, value)
+		}
+		return protobufMessageField(fieldNumber, data)
+	}
+	gauge := protobufMessageField(2,
+		protobufStringField(1, "system.cpu.utilization"),
+		protobufStringField(3, "1"),
+		protobufMessageField(5, protobufMessageField(1,
+			attribute(7, "cpu", protobufVarintField(3, 0)),
+			protobufFixed64Field(2, 1699999990000000000),
+			protobufFixed64Field(3, 1700000000500000000),
+			protobufDoubleField(4, 0.25))))
+	sum := protobufMessageField(2,
+		protobufStringField(1, "http.requests"),
+		protobufMessageField(7,
+			protobufMessageField(1,
+				attribute(7, "http.method", protobufStringField(1, "GET")),
+				protobufFixed64Field(3, 1700000000000000000),
+				protobufFixed64Field(6, 5)),
+			protobufVarintField(2, 2),
+			protobufVarintField(3, 1)))
+	histogram := protobufMessageField(2,
+		protobufStringField(1, "http.duration"),
+		protobufMessageField(9, protobufMessageField(1,
+			protobufFixed64Field(3, 1700000000000000000),
+			protobufFixed64Field(4, 3),
+			protobufDoubleField(5, 0.7),
+			packedFixed64(6, 1, 2, 0),
+			packedFixed64(7, math.Float64bits(0.1), math.Float64bits(0.5))),
+			protobufVarintField(2, 2)))
+	summary := protobufMessageField(2,
+		protobufStringField(1, "rpc.latency"),
+		protobufMessageField(11, protobufMessageField(1,
+			protobufFixed64Field(3, 1700000000000000000),
+			protobufFixed64Field(4, 3),
+			protobufDoubleField(5, 0.7),
+			protobufMessageField(6, protobufDoubleField(1, 0.5), protobufDoubleField(2, 0.2)))))
+	return protobufMessageField(1,
+		protobufMessageField(1,
+			attribute(1, "service.name", protobufStringField(1, "api")),
+			attribute(1, "host.name", protobufStringField(1, "web01"))),
+		protobufMessageField(2,
+			protobufMessageField(1, protobufStringField(1, "io.test"), protobufStringField(2, "1.0")),
+			gauge, sum, histogram, summary))
+}
+
+var otlpFixtureMessages = []metricMessage{
+	{metricPath: "system.cpu.utilization;cpu=0;service.name=api", value: 0.25, timestamp: 1700000000},
+	{metricPath: "http.requests;http.method=GET;service.name=api", value: 5, timestamp: 1700000000},
+	{metricPath: "http.duration.count;service.name=api", value: 3, timestamp: 1700000000},
+	{metricPath: "http.duration.sum;service.name=api", value: 0.7, timestamp: 1700000000},
+	{metricPath: "http.duration.bucket.le_0_1;service.name=api", value: 1, timestamp: 1700000000},
+	{metricPath: "http.duration.bucket.le_0_5;service.name=api", value: 2, timestamp: 1700000000},
+	{metricPath: "http.duration.bucket.le_inf;service.name=api", value: 0, timestamp: 1700000000},
+}
+
+// Summaries aren't supported, so the summary is rejected as one data point
+func TestConvertOtlpRequest(t *testing.T) {
+	converter, err := newOtlpConverter(OtlpMetricPath, true, OtlpResourceTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var jsonRequest otlpExportRequest
+	if err := json.Unmarshal([]byte(otlpJsonFixture), &jsonRequest); err != nil {
+		t.Fatal(err)
+	}
+	protobufRequest, err := decodeOtlpRequest(otlpProtobufFixture())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		request otlpExportRequest
+	}{
+		{"JSON", jsonRequest},
+		{"protobuf", protobufRequest},
+	}
+	for _, test := range tests {
+		messages, rejected := converter.convertRequest(test.request)
+		if !reflect.DeepEqual(messages, otlpFixtureMessages) {
+			t.Errorf("%s: got %v, expected %v", test.name, messages, otlpFixtureMessages)
+		}
+		if len(rejected) != 1 || rejected[0].reason != OtlpRejectedDataPoint || !strings.HasPrefix(rejected[0].line, "rpc.latency:") {
+			t.Errorf("%s: got rejected %v, expected the summary", test.name, rejected)
+		}
+	}
+}
+
+func TestOtlpMetricPathTemplate(t *testing.T) {
+	converter, err := newOtlpConverter(`{{ index .Resource "service.name"}}.{{ .ScopeName}}.{{ .Name}}`, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request otlpExportRequest
+	if err := json.Unmarshal([]byte(otlpJsonFixture), &request); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := converter.convertRequest(request)
+	if len(messages) == 0 || messages[0].metricPath != "api.io.test.system.cpu.utilization" {
+		t.Errorf("got %v, expected api.io.test.system.cpu.utilization first", messages)
+	}
+}
+
+func TestConvertOtlpRequestRejections(t *testing.T) {
+	converter, err := newOtlpConverter(OtlpMetricPath, true, OtlpResourceTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		metrics  string
+		expected []CounterId
+	}{
+		{"exponential histogram", `{"name": "a", "exponentialHistogram": {"dataPoints": [{}]}}`, []CounterId{OtlpRejectedDataPoint}},
+		{"data point without a value", `{"name": "a", "gauge": {"dataPoints": [{"timeUnixNano": "1700000000000000000"}]}}`, []CounterId{OtlpRejectedDataPoint}},
+		{"empty name", `{"name": "", "gauge": {"dataPoints": [{"asDouble": 1}]}}`, []CounterId{OtlpRejectedDataPoint}},
+		{"non-finite value", `{"name": "a", "gauge": {"dataPoints": [{"asDouble": "Infinity"}, {"asDouble": 1}]}}`, []CounterId{InvalidMessageNonFiniteValue}},
+		{"mismatching buckets", `{"name": "a", "histogram": {"dataPoints": [{"count": "1", "bucketCounts": ["1"], "explicitBounds": [0.1]}]}}`, []CounterId{OtlpRejectedDataPoint}},
+		{"non-finite histogram sum", `{"name": "a", "histogram": {"dataPoints": [{"count": "1", "sum": "-Infinity"}]}}`, []CounterId{InvalidMessageNonFiniteValue}},
+	}
+	for _, test := range tests {
+		var request otlpExportRequest
+		if err := json.Unmarshal([]byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [`+test.metrics+`]}]}]}`), &request); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		_, rejected := converter.convertRequest(request)
+		var reasons []CounterId
+		for _, rejectedMessage := range rejected {
+			reasons = append(reasons, rejectedMessage.reason)
+		}
+		if !reflect.DeepEqual(reasons, test.expected) {
+			t.Errorf("%s: got rejected %v, expected %v", test.name, reasons, test.expected)
+		}
+	}
+}
+
+func TestDecodeOtlpRequestErrors(t *testing.T) {
+	fixture := otlpProtobufFixture()
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated request", fixture[:len(fixture)/2]},
+		{"truncated last byte", fixture[:len(fixture)-1]},
+		{"malformed key", []byte{0x80}},
+		{"truncated data point", protobufMessageField(1, protobufMessageField(2, protobufMessageField(2, protobufMessageField(5, protobufMessageField(1, []byte{0x21, 0x00})))))},
+		{"odd packed bucket counts", protobufMessageField(1, protobufMessageField(2, protobufMessageField(2, protobufMessageField(9, protobufMessageField(1, protobufMessageField(6, []byte{1, 2, 3}))))))},
+	}
+	for _, test := range tests {
+		if request, err := decodeOtlpRequest(test.data); err == nil {
+			t.Errorf("%s: got %v, expected an error", test.name, request)
+		}
+	}
+}
+
+func gzipCompress(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+	return compressed.Bytes()
+}
+
+func TestOtlpHandleHttpRequest(t *testing.T) {
+	defer func(maxBodySize int64) { *httpMaxBodySize = maxBodySize }(*httpMaxBodySize)
+	*httpMaxBodySize = 5000
+	converter, err := newOtlpConverter(OtlpMetricPath, true, OtlpResourceTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		method          string
+		contentType     string
+		contentEncoding string
+		body            []byte
+		status          int
+		messages        int
+		response        string // Expected to be contained in the response
+	}{
+		{"protobuf", http.MethodPost, "application/x-protobuf", "", otlpProtobufFixture(), http.StatusOK, 7, "unsupported metric types"},
+		{"JSON", http.MethodPost, "application/json", "", []byte(otlpJsonFixture), http.StatusOK, 7, `"rejectedDataPoints":"1"`},
+		{"gzip", http.MethodPost, "application/x-protobuf", "gzip", gzipCompress(otlpProtobufFixture()), http.StatusOK, 7, ""},
+		{"GET", http.MethodGet, "", "", nil, http.StatusMethodNotAllowed, 0, ""},
+		{"invalid JSON", http.MethodPost, "application/json", "", []byte(`{"resourceMetrics": [`), http.StatusBadRequest, 0, "Invalid OTLP body"},
+		{"invalid protobuf", http.MethodPost, "application/x-protobuf", "", []byte{0x80}, http.StatusBadRequest, 0, "Invalid OTLP body"},
+		{"invalid gzip", http.MethodPost, "application/x-protobuf", "gzip", otlpProtobufFixture(), http.StatusBadRequest, 0, "Invalid gzip body"},
+		{"body too large", http.MethodPost, "application/x-protobuf", "", make([]byte, 5001), http.StatusRequestEntityTooLarge, 0, ""},
+		{"decompressed body too large", http.MethodPost, "application/x-protobuf", "gzip", gzipCompress(make([]byte, 5001)), http.StatusRequestEntityTooLarge, 0, "-httpmaxbodysize"},
+	}
+	for _, test := range tests {
+		incomingMessageChannel := make(chan metricMessage, 10)
+		request := httptest.NewRequest(test.method, OtlpHttpPath, bytes.NewReader(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		request.Header.Set("Content-Encoding", test.contentEncoding)
+		recorder := httptest.NewRecorder()
+		rejectedBefore := counterData[HttpRequestRejected]
+		converter.handleHttpRequest(recorder, request, messageOrigin{}, incomingMessageChannel)
+		if recorder.Code != test.status || len(incomingMessageChannel) != test.messages || !strings.Contains(recorder.Body.String(), test.response) {
+			t.Errorf("%s: got status %d, %d messages and response %q, expected status %d and %d messages", test.name, recorder.Code, len(incomingMessageChannel), recorder.Body.String(), test.status, test.messages)
+		}
+		if isRejected := counterData[HttpRequestRejected] > rejectedBefore; isRejected != (test.status != http.StatusOK) {
+			t.Errorf("%s: got rejected request counted %t with status %d", test.name, isRejected, recorder.Code)
+		}
+	}
+}
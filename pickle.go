@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pickle opcodes understood by the restricted unpickler. Opcodes that can
+// instantiate objects or call functions (GLOBAL, REDUCE, BUILD, INST, OBJ,
+// NEWOBJ, STACK_GLOBAL, PERSID, EXT*) are deliberately not supported.
+const (
+	pickleMark           = '('
+	pickleStop           = '.'
+	picklePop            = '0'
+	picklePopMark        = '1'
+	pickleDup            = '2'
+	pickleFloat          = 'F'
+	pickleInt            = 'I'
+	pickleBinInt         = 'J'
+	pickleBinInt1        = 'K'
+	pickleLong           = 'L'
+	pickleBinInt2        = 'M'
+	pickleNone           = 'N'
+	pickleString         = 'S'
+	pickleBinString      = 'T'
+	pickleShortBinString = 'U'
+	pickleUnicode        = 'V'
+	pickleBinUnicode     = 'X'
+	pickleAppend         = 'a'
+	pickleAppends        = 'e'
+	pickleGet            = 'g'
+	pickleBinGet         = 'h'
+	pickleLongBinGet     = 'j'
+	pickleList           = 'l'
+	picklePut            = 'p'
+	pickleBinPut         = 'q'
+	pickleLongBinPut     = 'r'
+	pickleTuple          = 't'
+	pickleEmptyList      = ']'
+	pickleEmptyTuple     = ')'
+	pickleBinFloat       = 'G'
+	pickleBinBytes       = 'B'
+	pickleShortBinBytes  = 'C'
+	pickleProto          = 0x80
+	pickleTuple1         = 0x85
+	pickleTuple2         = 0x86
+	pickleTuple3         = 0x87
+	pickleNewTrue        = 0x88
+	pickleNewFalse       = 0x89
+	pickleLong1          = 0x8a
+	pickleLong4          = 0x8b
+	pickleShortBinUni    = 0x8c
+	pickleBinUnicode8    = 0x8d
+	pickleBinBytes8      = 0x8e
+	pickleMemoize        = 0x94
+	pickleFrame          = 0x95
+)
+
+// pickleListValue is a pointer type so that APPEND on a memoized list is visible through the memo
+type pickleListValue struct {
+	items []interface{}
+}
+
+type pickleTupleValue []interface{}
+
+var errPickleTruncated = errors.New("Truncated pickle data")
+
+// unpickle decodes a pickle containing only plain data: lists, tuples, strings, numbers, booleans and None
+func unpickle(data []byte) (interface{}, error) {
+	reader := bytes.NewReader(data)
+	var stack []interface{}
+	var marks []int
+	memo := make(map[uint32]interface{})
+
+	pop := func() (interface{}, error) {
+		if len(stack) == 0 || (len(marks) > 0 && len(stack) <= marks[len(marks)-1]) {
+			return nil, errors.New("Pickle stack underflow")
+		}
+		value := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return value, nil
+	}
+	popMark := func() ([]interface{}, error) {
+		if len(marks) == 0 {
+			return nil, errors.New("Pickle mark not found")
+		}
+		mark := marks[len(marks)-1]
+		marks = marks[:len(marks)-1]
+		items := append([]interface{}{}, stack[mark:]...)
+		stack = stack[:mark]
+		return items, nil
+	}
+	readBytes := func(length uint64) ([]byte, error) {
+		if length > uint64(reader.Len()) {
+			return nil, errPickleTruncated
+		}
+		buffer := make([]byte, length)
+		_, err := io.ReadFull(reader, buffer)
+		return buffer, err
+	}
+	readLine := func() (string, error) {
+		var line []byte
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return "", errPickleTruncated
+			}
+			if b == '\n' {
+				return string(line), nil
+			}
+			line = append(line, b)
+		}
+	}
+	readUint := func(size int) (uint64, error) {
+		buffer, err := readBytes(uint64(size))
+		if err != nil {
+			return 0, err
+		}
+		var value uint64
+		for i := size - 1; i >= 0; i-- {
+			value = value<<8 | uint64(buffer[i])
+		}
+		return value, nil
+	}
+	memoPut := func(index uint32) error {
+		if len(stack) == 0 {
+			return errors.New("Pickle stack underflow")
+		}
+		memo[index] = stack[len(stack)-1]
+		return nil
+	}
+	memoGet := func(index uint32) error {
+		value, ok := memo[index]
+		if !ok {
+			return errors.New("Pickle memo key not found")
+		}
+		stack = append(stack, value)
+		return nil
+	}
+
+	for {
+		opcode, err := reader.ReadByte()
+		if err != nil {
+			return nil, errPickleTruncated
+		}
+		switch opcode {
+		case pickleProto:
+			if _, err = reader.ReadByte(); err != nil {
+				return nil, errPickleTruncated
+			}
+		case pickleFrame:
+			_, err = readUint(8)
+		case pickleStop:
+			return pop()
+		case pickleMark:
+			marks = append(marks, len(stack))
+		case picklePop:
+			_, err = pop()
+		case picklePopMark:
+			_, err = popMark()
+		case pickleDup:
+			if len(stack) == 0 {
+				return nil, errors.New("Pickle stack underflow")
+			}
+			stack = append(stack, stack[len(stack)-1])
+		case pickleNone:
+			stack = append(stack, nil)
+		case pickleNewTrue:
+			stack = append(stack, true)
+		case pickleNewFalse:
+			stack = append(stack, false)
+		case pickleInt:
+			var line string
+			if line, err = readLine(); err == nil {
+				switch line {
+				case "00":
+					stack = append(stack, false)
+				case "01":
+					stack = append(stack, true)
+				default:
+					var value int64
+					if value, err = strconv.ParseInt(line, 10, 64); err == nil {
+						stack = append(stack, value)
+					}
+				}
+			}
+		case pickleLong:
+			var line string
+			if line, err = readLine(); err == nil {
+				line = strings.TrimSuffix(line, "L")
+				if value, parseErr := strconv.ParseInt(line, 10, 64); parseErr == nil {
+					stack = append(stack, value)
+				} else if bigValue, ok := new(big.Float).SetString(line); ok {
+					floatValue, _ := bigValue.Float64()
+					stack = append(stack, floatValue)
+				} else {
+					err = parseErr
+				}
+			}
+		case pickleBinInt:
+			var value uint64
+			if value, err = readUint(4); err == nil {
+				stack = append(stack, int64(int32(value)))
+			}
+		case pickleBinInt1:
+			var value uint64
+			if value, err = readUint(1); err == nil {
+				stack = append(stack, int64(value))
+			}
+		case pickleBinInt2:
+			var value uint64
+			if value, err = readUint(2); err == nil {
+				stack = append(stack, int64(value))
+			}
+		case pickleLong1, pickleLong4:
+			var length uint64
+			if opcode == pickleLong1 {
+				length, err = readUint(1)
+			} else {
+				length, err = readUint(4)
+			}
+			if err != nil {
+				break
+			}
+			var buffer []byte
+			if buffer, err = readBytes(length); err == nil {
+				stack = append(stack, decodePickleLong(buffer))
+			}
+		case pickleFloat:
+			var line string
+			if line, err = readLine(); err == nil {
+				var value float64
+				if value, err = strconv.ParseFloat(line, 64); err == nil {
+					stack = append(stack, value)
+				}
+			}
+		case pickleBinFloat:
+			var buffer []byte
+			if buffer, err = readBytes(8); err == nil {
+				stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(buffer)))
+			}
+		case pickleString:
+			var line string
+			if line, err = readLine(); err == nil {
+				var value string
+				if value, err = strconv.Unquote(line); err == nil {
+					stack = append(stack, value)
+				} else if len(line) >= 2 && line[0] == '\'' && line[len(line)-1] == '\'' {
+					// Python quotes strings with single quotes, which Go reserves for runes
+					quoted := strings.ReplaceAll(strings.ReplaceAll(line[1:len(line)-1], `\'`, `'`), `"`, `\"`)
+					value, err = strconv.Unquote(`"` + quoted + `"`)
+					stack = append(stack, value)
+				}
+			}
+		case pickleUnicode:
+			var line string
+			if line, err = readLine(); err == nil {
+				stack = append(stack, decodeRawUnicodeEscape(line))
+			}
+		case pickleBinString, pickleBinUnicode, pickleBinBytes, pickleShortBinString, pickleShortBinUni, pickleShortBinBytes, pickleBinUnicode8, pickleBinBytes8:
+			var length uint64
+			switch opcode {
+			case pickleShortBinString, pickleShortBinUni, pickleShortBinBytes:
+				length, err = readUint(1)
+			case pickleBinUnicode8, pickleBinBytes8:
+				length, err = readUint(8)
+			default:
+				length, err = readUint(4)
+			}
+			if err != nil {
+				break
+			}
+			var buffer []byte
+			if buffer, err = readBytes(length); err == nil {
+				stack = append(stack, string(buffer))
+			}
+		case pickleEmptyList:
+			stack = append(stack, &pickleListValue{})
+		case pickleList:
+			var items []interface{}
+			if items, err = popMark(); err == nil {
+				stack = append(stack, &pickleListValue{items: items})
+			}
+		case pickleAppend, pickleAppends:
+			var items []interface{}
+			if opcode == pickleAppend {
+				var item interface{}
+				item, err = pop()
+				items = []interface{}{item}
+			} else {
+				items, err = popMark()
+			}
+			if err != nil {
+				break
+			}
+			if len(stack) == 0 {
+				return nil, errors.New("Pickle stack underflow")
+			}
+			list, ok := stack[len(stack)-1].(*pickleListValue)
+			if !ok {
+				return nil, errors.New("Pickle append to non-list")
+			}
+			list.items = append(list.items, items...)
+		case pickleEmptyTuple:
+			stack = append(stack, pickleTupleValue{})
+		case pickleTuple:
+			var items []interface{}
+			if items, err = popMark(); err == nil {
+				stack = append(stack, pickleTupleValue(items))
+			}
+		case pickleTuple1, pickleTuple2, pickleTuple3:
+			size := int(opcode-pickleTuple1) + 1
+			if len(stack) < size || (len(marks) > 0 && len(stack)-size < marks[len(marks)-1]) {
+				return nil, errors.New("Pickle stack underflow")
+			}
+			items := append(pickleTupleValue{}, stack[len(stack)-size:]...)
+			stack = append(stack[:len(stack)-size], items)
+		case picklePut:
+			var line string
+			if line, err = readLine(); err == nil {
+				var index uint64
+				if index, err = strconv.ParseUint(line, 10, 32); err == nil {
+					err = memoPut(uint32(index))
+				}
+			}
+		case pickleBinPut, pickleLongBinPut:
+			var index uint64
+			if opcode == pickleBinPut {
+				index, err = readUint(1)
+			} else {
+				index, err = readUint(4)
+			}
+			if err == nil {
+				err = memoPut(uint32(index))
+			}
+		case pickleMemoize:
+			err = memoPut(uint32(len(memo)))
+		case pickleGet:
+			var line string
+			if line, err = readLine(); err == nil {
+				var index uint64
+				if index, err = strconv.ParseUint(line, 10, 32); err == nil {
+					err = memoGet(uint32(index))
+				}
+			}
+		case pickleBinGet, pickleLongBinGet:
+			var index uint64
+			if opcode == pickleBinGet {
+				index, err = readUint(1)
+			} else {
+				index, err = readUint(4)
+			}
+			if err == nil {
+				err = memoGet(uint32(index))
+			}
+		default:
+			return nil, errors.New("Unsupported pickle opcode: " + strconv.Itoa(int(opcode)))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeRawUnicodeEscape decodes the \uXXXX and \UXXXXXXXX escapes used by Python's raw-unicode-escape codec
+func decodeRawUnicodeEscape(text string) string {
+	if !strings.Contains(text, `\`) {
+		return text
+	}
+	var decoded strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && (text[i+1] == 'u' || text[i+1] == 'U') {
+			digits := 4
+			if text[i+1] == 'U' {
+				digits = 8
+			}
+			if i+2+digits <= len(text) {
+				if codePoint, err := strconv.ParseUint(text[i+2:i+2+digits], 16, 32); err == nil {
+					decoded.WriteRune(rune(codePoint))
+					i += 1 + digits
+					continue
+				}
+			}
+		}
+		decoded.WriteByte(text[i])
+	}
+	return decoded.String()
+}
+
+// decodePickleLong decodes a little-endian two's complement integer, falling back to float64 if it doesn't fit in int64
+func decodePickleLong(data []byte) interface{} {
+	if len(data) == 0 {
+		return int64(0)
+	}
+	if len(data) <= 8 {
+		var value uint64
+		for i := len(data) - 1; i >= 0; i-- {
+			value = value<<8 | uint64(data[i])
+		}
+		shift := uint(64 - 8*len(data))
+		return int64(value<<shift) >> shift
+	}
+	bigEndian := make([]byte, len(data))
+	for i := range data {
+		bigEndian[len(data)-1-i] = data[i]
+	}
+	value := new(big.Int).SetBytes(bigEndian)
+	if data[len(data)-1]&0x80 != 0 {
+		value.Sub(value, new(big.Int).Lsh(big.NewInt(1), uint(8*len(data))))
+	}
+	floatValue, _ := new(big.Float).SetInt(value).Float64()
+	return floatValue
+}
+
+// pickleNumber converts a decoded pickle value to a float64, like carbon does with float()
+func pickleNumber(value interface{}) (float64, error) {
+	switch typedValue := value.(type) {
+	case int64:
+		return float64(typedValue), nil
+	case float64:
+		return typedValue, nil
+	case bool:
+		if typedValue {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(typedValue), 64)
+	}
+	return 0, errors.New("Pickle value is not a number")
+}
+
+// parsePickleMessages decodes a pickled list of (path, (timestamp, value)) tuples. Valid
+// messages are returned even if some of the tuples are invalid, along with the number of invalid ones.
+func parsePickleMessages(data []byte, origin messageOrigin) ([]metricMessage, int, error) {
+	decoded, err := unpickle(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, ok := decoded.(*pickleListValue)
+	if !ok {
+		return nil, 0, errors.New("Pickle payload is not a list")
+	}
+
+	var outputMessages []metricMessage
+	invalidMessages := 0
+	for _, item := range list.items {
+		outputMessage, err := pickleItemToMessage(item)
+		if err != nil {
+			recordDeadLetter(countInvalidMessage(err), origin, fmt.Sprint(item))
+			countClientInvalidMessage(origin)
+			invalidMessages++
+			continue
+		}
+		outputMessage.messageOrigin = origin
+		outputMessages = append(outputMessages, outputMessage)
+	}
+	return outputMessages, invalidMessages, nil
+}
+
+func pickleItemToMessage(item interface{}) (metricMessage, error) {
+	var outputMessage metricMessage
+	metricTuple, ok := item.(pickleTupleValue)
+	if !ok || len(metricTuple) != 2 {
+		return outputMessage, invalidMessageError{InvalidMessageFieldCount, "Pickle metric is not a (path, datapoint) tuple"}
+	}
+	datapoint, ok := metricTuple[1].(pickleTupleValue)
+	if !ok || len(datapoint) != 2 {
+		return outputMessage, invalidMessageError{InvalidMessageFieldCount, "Pickle datapoint is not a (timestamp, value) tuple"}
+	}
+	if outputMessage.metricPath, ok = metricTuple[0].(string); !ok || len(outputMessage.metricPath) < 1 {
+		return outputMessage, invalidMessageError{InvalidMessageEmptyPath, "Invalid metric_path in pickle message"}
+	}
+	var err error
+	if outputMessage.metricPath, err = normalizeMetricPath(outputMessage.metricPath); err != nil {
+		return outputMessage, invalidMessageError{InvalidMessageTags, "Invalid tags in pickle message"}
+	}
+	timestamp, err := pickleNumber(datapoint[0])
+	if err != nil || math.IsNaN(timestamp) || timestamp >= math.MaxInt64 || timestamp < math.MinInt64 {
+		return outputMessage, invalidMessageError{InvalidMessageTimestamp, "Invalid timestamp in pickle message"}
+	}
+	outputMessage.timestamp = int64(timestamp)
+	if outputMessage.value, err = pickleNumber(datapoint[1]); err != nil {
+		return outputMessage, invalidMessageError{InvalidMessageValue, "Invalid value in pickle message"}
+	}
+	return outputMessage, validateMetricMessage(outputMessage, "pickle message")
+}
+
+// handleIncomingPickleConnection reads length-prefixed pickle frames, as sent by carbon-relay
+func handleIncomingPickleConnection(connection net.Conn, profile *policyProfile, incomingMessageChannel chan metricMessage) {
+	defer connection.Close()
+	client, err := connectionClientIdentity(connection)
+	if err != nil {
+		return
+	}
+	reader := bufio.NewReader(connection)
+	origin := messageOrigin{source: connection.RemoteAddr().String(), client: client, profile: profile}
+	counterData[ClientConnectionOpening]++
+	gaugeData[ClientConnectionsActive]++
+	header := make([]byte, 4)
+	for {
+		// Like lines, each frame has -idletimeout seconds to begin and -readtimeout seconds to arrive in full
+		if err := waitForNextMessage(connection, reader); err != nil {
+			break // Break out of for loop and close connection
+		}
+		if _, err := io.ReadFull(reader, header); err != nil {
+			countTimeout(err, ClientConnectionReadTimeout)
+			break
+		}
+		frameLength := binary.BigEndian.Uint32(header)
+		if uint64(frameLength) > uint64(*maxPickleFrameSize) {
+			// There's no way to resynchronize with the sender without reading the whole frame, so give up on the connection
+			counterData[OversizedPickleFrame]++
+			break
+		}
+		frame := make([]byte, frameLength)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			countTimeout(err, ClientConnectionReadTimeout)
+			break
+		}
+		counterData[ReceivedPickleFrame]++
+
+		incomingMessages, invalidMessages, err := parsePickleMessages(frame, origin)
+		if err != nil {
+			counterData[InvalidPickleFrame]++
+			continue
+		}
+		counterData[ReceivedMessage] += int64(len(incomingMessages) + invalidMessages)
+		for _, incomingMessage := range incomingMessages {
+			writeIncomingMessage(incomingMessageChannel, incomingMessage)
+		}
+	}
+	counterData[ClientConnectionClosing]++
+	gaugeData[ClientConnectionsActive]--
+}
+
+// appendPickledMessages appends a protocol 2 pickle of a list of (path, (timestamp, value)) tuples, as carbon-relay sends them
+func appendPickledMessages(buffer []byte, outMessages []metricMessage) []byte {
+	buffer = append(buffer, pickleProto, 2, pickleEmptyList, pickleMark)
+	for _, outMessage := range outMessages {
+		buffer = append(buffer, pickleBinUnicode)
+		buffer = binary.LittleEndian.AppendUint32(buffer, uint32(len(outMessage.metricPath)))
+		buffer = append(buffer, outMessage.metricPath...)
+		if outMessage.timestamp >= math.MinInt32 && outMessage.timestamp <= math.MaxInt32 {
+			buffer = append(buffer, pickleBinInt)
+			buffer = binary.LittleEndian.AppendUint32(buffer, uint32(outMessage.timestamp))
+		} else {
+			buffer = append(buffer, pickleLong1, 8)
+			buffer = binary.LittleEndian.AppendUint64(buffer, uint64(outMessage.timestamp))
+		}
+		buffer = append(buffer, pickleBinFloat)
+		buffer = binary.BigEndian.AppendUint64(buffer, math.Float64bits(outMessage.value))
+		buffer = append(buffer, pickleTuple2, pickleTuple2)
+	}
+	return append(buffer, pickleAppends, pickleStop)
+}
+
+// writePickleBatches sends length-prefixed pickle batches, flushing when a batch is full or its oldest metric has waited batchLatency.
+// The unsent messages from a previous connection, if any, are sent first. It returns once the channel has been closed
+// and the last batch has been sent, or with the batch that may not have been sent if a write fails.
+func writePickleBatches(connection io.Writer, outgoingMessageChannel chan metricMessage, unsent []metricMessage, batchSize int, batchLatency time.Duration, closed chan struct{}) ([]metricMessage, error) {
+	batch := make([]metricMessage, 0, max(batchSize, len(unsent)))
+	batch = append(batch, unsent...)
+	var frame []byte
+	ticker := time.NewTicker(batchLatency)
+	defer ticker.Stop()
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		frame = append(frame[:0], 0, 0, 0, 0)
+		frame = appendPickledMessages(frame, batch)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		if _, err := connection.Write(frame); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		counterData[SentPickleBatch]++
+		return nil
+	}
+
+	if err := flush(); err != nil {
+		return batch, err
+	}
+	for {
+		select {
+		case outMessage, ok := <-outgoingMessageChannel:
+			if !ok {
+				if err := flush(); err != nil {
+					return batch, err
+				}
+				return nil, nil
+			}
+			batch = append(batch, outMessage)
+			if len(batch) >= batchSize {
+				if err := flush(); err != nil {
+					return batch, err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return batch, err
+			}
+		case <-closed:
+			return batch, errDestinationClosed
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Payloads pickled by carbon-relay under Python 3 and Python 2. The datapoint tuple is shared between the metrics,
+// so the second metric refers to it through the memo.
+func TestParsePickleMessages(t *testing.T) {
+	expected := []metricMessage{
+		{metricPath: "a.b", value: 1.5, timestamp: 1700000000},
+		{metricPath: "c.d", value: 1.5, timestamp: 1700000000},
+	}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"protocol 0", "(lp0\n(Va.b\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vc.d\np4\ng2\ntp5\na."},
+		{"protocol 0 from python 2", "(lp0\n(S'a.b'\np1\n(L1700000000L\nF1.5\ntp2\ntp3\na(S'c.d'\np4\ng2\ntp5\na."},
+		{"protocol 2", "\x80\x02]q\x00(X\x03\x00\x00\x00a.bq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x03\x00\x00\x00c.dq\x04h\x02\x86q\x05e."},
+		{"protocol 2 with short strings", "\x80\x02]q\x00(U\x03a.bq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03U\x03c.dq\x04h\x02\x86q\x05e."},
+	}
+	for _, test := range tests {
+		messages, invalidMessages, err := parsePickleMessages([]byte(test.data), messageOrigin{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if invalidMessages != 0 || !reflect.DeepEqual(messages, expected) {
+			t.Errorf("%s: got %v with %d invalid, expected %v", test.name, messages, invalidMessages, expected)
+		}
+	}
+}
+
+// Opcodes that import or call anything must be rejected before they are executed
+func TestUnpickleRejectsUnsafeOpcodes(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"GLOBAL in protocol 0", "(lp0\ncposix\nsystem\np1\n(Vtrue\np2\ntp3\nRp4\na."},
+		{"GLOBAL in protocol 2", "\x80\x02]q\x00cposix\nsystem\nq\x01X\x04\x00\x00\x00trueq\x02\x85q\x03Rq\x04a."},
+		{"REDUCE", "\x80\x02]q\x00)Rq\x01a."},
+		{"STACK_GLOBAL", "\x80\x04\x8c\x05posix\x8c\x06system\x93."},
+		{"INST", "(iposix\nsystem\n."},
+		{"BUILD", "\x80\x02}b."},
+	}
+	for _, test := range tests {
+		if _, err := unpickle([]byte(test.data)); err == nil || !strings.HasPrefix(err.Error(), "Unsupported pickle opcode") {
+			t.Errorf("%s: got error %v, expected an unsupported opcode", test.name, err)
+		}
+	}
+}
+
+func TestUnpickleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"missing STOP", "(lp0\n"},
+		{"truncated BINUNICODE", "\x80\x02X\x03\x00\x00\x00a"},
+		{"unknown memo key", "\x80\x02h\x07."},
+		{"APPEND without list", "\x80\x02K\x01K\x02a."},
+		{"TUPLE without MARK", "\x80\x02K\x01t."},
+	}
+	for _, test := range tests {
+		if _, err := unpickle([]byte(test.data)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
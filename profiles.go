@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// DefaultProfileName is the profile built from the commandline flags, used by listeners without a profile option
+const DefaultProfileName = "default"
+
+// policyProfile holds the thresholds for metric paths first received on the listeners bound to it
+type policyProfile struct {
+	name                        string
+	minimumTimeInterval         int64
+	maxConsecutiveDryMessages   uint64
+	isNewMetricEnabledByDefault bool
+	storageSchema               map[string]overrideData
+}
+
+func createDefaultPolicyProfile() *policyProfile {
+	return &policyProfile{
+		name:                        DefaultProfileName,
+		minimumTimeInterval:         *minimumTimeInterval,
+		maxConsecutiveDryMessages:   *maxConsecutiveDryMessages,
+		isNewMetricEnabledByDefault: *isNewMetricEnabledByDefault,
+		storageSchema:               createStorageSchema(*override),
+	}
+}
+
+// getPolicyProfilesFromFile reads profiles from an ini file with one section per profile. Settings that
+// are left out are taken from the default profile, which may itself be changed with a "default" section.
+func getPolicyProfilesFromFile(filename string, defaultProfile *policyProfile) map[string]*policyProfile {
+	text := getFileLineData(filename)
+	iniData := getFieldsFromLineData(text)
+	return extractPolicyProfileFields(iniData, defaultProfile)
+}
+
+func extractPolicyProfileFields(iniData map[string]map[string]string, defaultProfile *policyProfile) map[string]*policyProfile {
+	// The default profile has to be complete before the other profiles are copied from it
+	if sectionData, ok := iniData[DefaultProfileName]; ok {
+		applyPolicyProfileFields(defaultProfile, sectionData)
+	}
+	profiles := map[string]*policyProfile{DefaultProfileName: defaultProfile}
+	for section, sectionData := range iniData {
+		if section == DefaultProfileName {
+			continue
+		}
+		profile := *defaultProfile
+		profile.name = section
+		applyPolicyProfileFields(&profile, sectionData)
+		profiles[section] = &profile
+	}
+	return profiles
+}
+
+func applyPolicyProfileFields(profile *policyProfile, sectionData map[string]string) {
+	iniBooleanPattern := regexp.MustCompile(`^(?:(1|on|true|yes)|(0|off|false|no|none))$`)
+
+	if minimumTimeIntervalText, ok := sectionData["minimumtimeinterval"]; ok {
+		value, err := strconv.ParseInt(minimumTimeIntervalText, 10, 64)
+		if err != nil || value < 0 {
+			log.Println(`Invalid value for "minimumtimeinterval" in profile "` + profile.name + `"`)
+			os.Exit(1)
+		}
+		profile.minimumTimeInterval = value
+	}
+
+	if maxDryMessagesText, ok := sectionData["maxdrymessages"]; ok {
+		value, err := strconv.ParseUint(maxDryMessagesText, 10, 64)
+		if err != nil {
+			log.Println(`Invalid value for "maxdrymessages" in profile "` + profile.name + `"`)
+			os.Exit(1)
+		}
+		profile.maxConsecutiveDryMessages = value
+	}
+
+	if enableNewMetricsText, ok := sectionData["enablenewmetrics"]; ok {
+		enableNewMetricsResult := iniBooleanPattern.FindStringSubmatch(enableNewMetricsText)
+		if enableNewMetricsResult == nil {
+			log.Println(`Invalid value for "enablenewmetrics" in profile "` + profile.name + `"`)
+			os.Exit(1)
+		}
+		profile.isNewMetricEnabledByDefault = (enableNewMetricsResult[2] == "")
+	}
+
+	if overrideFilename, ok := sectionData["override"]; ok {
+		profile.storageSchema = createStorageSchema(overrideFilename)
+	}
+
+	for key := range sectionData {
+		switch key {
+		case "minimumtimeinterval", "maxdrymessages", "enablenewmetrics", "override":
+		default:
+			log.Println(`Unknown key "` + key + `" in profile "` + profile.name + `"`)
+			os.Exit(1)
+		}
+	}
+}
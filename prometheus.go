@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// Path of the Prometheus remote write endpoint
+const PrometheusHttpPath = "/api/v1/write"
+
+// PrometheusNameLabel is the label that holds the metric name
+const PrometheusNameLabel = "__name__"
+
+type prometheusTemplateData struct {
+	Name   string
+	Labels map[string]string
+}
+
+type prometheusSample struct {
+	value     float64
+	timestamp int64 // Milliseconds
+}
+
+// prometheusConverter translates Prometheus remote write requests into graphite messages
+type prometheusConverter struct {
+	metricPathTemplate *template.Template
+	graphiteTags       bool // Append all labels but the name as graphite tags
+}
+
+func newPrometheusConverter(metricPathTemplate string, graphiteTags bool) (*prometheusConverter, error) {
+	parsedTemplate, err := template.New("prometheusMetricPath").Parse(metricPathTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return &prometheusConverter{metricPathTemplate: parsedTemplate, graphiteTags: graphiteTags}, nil
+}
+
+// convertWriteRequest decodes a protobuf WriteRequest and converts each sample of each time series.
+// Only the timeseries field (1) is used, so metadata and other fields are skipped.
+func (converter *prometheusConverter) convertWriteRequest(data []byte) ([]metricMessage, []rejectedMessage, error) {
+	var outputMessages []metricMessage
+	var invalidSamples []rejectedMessage
+	reader := &protobufReader{data: data}
+	for !reader.done() {
+		fieldNumber, wireType, err := reader.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if fieldNumber != 1 || wireType != ProtobufLengthDelimited {
+			if err = reader.skip(wireType); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		timeSeries, err := reader.message()
+		if err != nil {
+			return nil, nil, err
+		}
+		labels, samples, err := decodePrometheusTimeSeries(timeSeries)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		metricPath, err := converter.metricPath(labels)
+		for _, sample := range samples {
+			// NaN is used by Prometheus for staleness markers, which have no meaning in graphite
+			if math.IsNaN(sample.value) {
+				continue
+			}
+			if err != nil {
+				invalidSamples = append(invalidSamples, rejectedMessage{PrometheusInvalidSample, fmt.Sprint(labels, " ", sample.value, " ", sample.timestamp)})
+				continue
+			}
+			outputMessage := metricMessage{metricPath: metricPath, value: sample.value, timestamp: sample.timestamp / 1000}
+			if err := validateMetricMessage(outputMessage, "Prometheus sample"); err != nil {
+				invalidSamples = append(invalidSamples, rejectedMessage{countInvalidMessage(err), fmt.Sprint(metricPath, " ", sample.value, " ", outputMessage.timestamp)})
+				continue
+			}
+			outputMessages = append(outputMessages, outputMessage)
+		}
+	}
+	return outputMessages, invalidSamples, nil
+}
+
+// decodePrometheusTimeSeries decodes the labels (1) and samples (2) of a TimeSeries message
+func decodePrometheusTimeSeries(reader *protobufReader) (map[string]string, []prometheusSample, error) {
+	labels := make(map[string]string)
+	var samples []prometheusSample
+	for !reader.done() {
+		fieldNumber, wireType, err := reader.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case fieldNumber == 1 && wireType == ProtobufLengthDelimited:
+			label, err := reader.message()
+			if err != nil {
+				return nil, nil, err
+			}
+			var name, value string
+			for !label.done() {
+				labelField, labelWireType, err := label.next()
+				if err != nil {
+					return nil, nil, err
+				}
+				switch {
+				case labelField == 1 && labelWireType == ProtobufLengthDelimited:
+					name, err = label.string()
+				case labelField == 2 && labelWireType == ProtobufLengthDelimited:
+					value, err = label.string()
+				default:
+					err = label.skip(labelWireType)
+				}
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			labels[name] = value
+		case fieldNumber == 2 && wireType == ProtobufLengthDelimited:
+			sampleReader, err := reader.message()
+			if err != nil {
+				return nil, nil, err
+			}
+			var sample prometheusSample
+			for !sampleReader.done() {
+				sampleField, sampleWireType, err := sampleReader.next()
+				if err != nil {
+					return nil, nil, err
+				}
+				switch {
+				case sampleField == 1 && sampleWireType == ProtobufFixed64:
+					sample.value, err = sampleReader.double()
+				case sampleField == 2 && sampleWireType == ProtobufVarint:
+					var timestamp uint64
+					timestamp, err = sampleReader.varint()
+					sample.timestamp = int64(timestamp)
+				default:
+					err = sampleReader.skip(sampleWireType)
+				}
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+			samples = append(samples, sample)
+		default:
+			if err = reader.skip(wireType); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return labels, samples, nil
+}
+
+// metricPath renders the template from the sanitized name and labels and, if enabled, appends
+// the labels as graphite tags. Empty path components, for example from missing labels, are removed.
+func (converter *prometheusConverter) metricPath(labels map[string]string) (string, error) {
+	name := sanitizePathComponent(labels[PrometheusNameLabel])
+	if name == "" {
+		return "", errors.New("Missing " + PrometheusNameLabel + " label in time series")
+	}
+	otherLabels := make(map[string]string, len(labels))
+	for labelName, labelValue := range labels {
+		if labelName != PrometheusNameLabel && labelValue != "" {
+			otherLabels[sanitizePathComponent(labelName)] = sanitizePathComponent(labelValue)
+		}
+	}
+
+	var templateOutputBuffer bytes.Buffer
+	if err := converter.metricPathTemplate.Execute(&templateOutputBuffer, prometheusTemplateData{Name: name, Labels: otherLabels}); err != nil {
+		return "", err
+	}
+	metricPath := removeEmptyPathComponents(templateOutputBuffer.String())
+	if metricPath == "" {
+		return "", errors.New("Prometheus metric path template rendered an empty path")
+	}
+	if converter.graphiteTags {
+		metricPath = appendGraphiteTags(metricPath, otherLabels)
+	}
+	return normalizeMetricPath(metricPath)
+}
+
+// handleHttpRequest accepts snappy compressed protobuf remote write requests, like Prometheus sends them
+func (converter *prometheusConverter) handleHttpRequest(responseWriter http.ResponseWriter, request *http.Request, origin messageOrigin, incomingMessageChannel chan metricMessage) {
+	if !acceptHttpPost(responseWriter, request) {
+		return
+	}
+	compressed, err := io.ReadAll(request.Body)
+	if err != nil {
+		counterData[HttpRequestRejected]++
+		http.Error(responseWriter, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	decodedLength, err := snappy.DecodedLen(compressed)
+	if err != nil || int64(decodedLength) > *httpMaxBodySize {
+		counterData[HttpRequestRejected]++
+		http.Error(responseWriter, "Invalid or too large snappy body", http.StatusBadRequest)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		counterData[HttpRequestRejected]++
+		http.Error(responseWriter, "Invalid snappy body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	incomingMessages, invalidSamples, err := converter.convertWriteRequest(data)
+	if err != nil {
+		counterData[HttpRequestRejected]++
+		http.Error(responseWriter, "Invalid protobuf body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	counterData[PrometheusReceivedSample] += int64(len(incomingMessages) + len(invalidSamples))
+	counterData[PrometheusInvalidSample] += int64(len(invalidSamples))
+	recordRejectedMessages(invalidSamples, origin)
+	for _, incomingMessage := range incomingMessages {
+		incomingMessage.messageOrigin = origin
+		writeIncomingMessage(incomingMessageChannel, incomingMessage)
+	}
+	responseWriter.WriteHeader(http.StatusNoContent)
+}
+
+func createPrometheusConverter() *prometheusConverter {
+	converter, err := newPrometheusConverter(*prometheusMetricPath, *prometheusGraphiteTags)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	return converter
+}
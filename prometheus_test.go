@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// A WriteRequest with one time series, up{job="node"}, and one sample of 1 at 1700000000123 milliseconds
+const prometheusWriteRequestFixture = "\x0a\x2f\x0a\x0e\x0a\x08__name__\x12\x02up\x0a\x0b\x0a\x03job\x12\x04node" +
+	"\x12\x10\x09\x00\x00\x00\x00\x00\x00\xf0\x3f\x10\xfb\xd0\x95\xff\xbc\x31"
+
+func prometheusTimeSeries(labels [][2]string, samples ...[]byte) []byte {
+	var parts [][]byte
+	for _, label := range labels {
+		parts = append(parts, protobufMessageField(1, protobufStringField(1, label[0]), protobufStringField(2, label[1])))
+	}
+	return protobufMessageField(1, append(parts, samples...)...)
+}
+
+func prometheusSampleField(value float64, timestamp uint64) []byte {
+	return protobufMessageField(2, protobufDoubleField(1, value), protobufVarintField(2, timestamp))
+}
+
+func TestConvertWriteRequest(t *testing.T) {
+	converter, err := newPrometheusConverter(PrometheusMetricPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		data     []byte
+		expected []metricMessage
+		invalid  []CounterId
+	}{
+		{"fixture", []byte(prometheusWriteRequestFixture), []metricMessage{{metricPath: "up;job=node", value: 1, timestamp: 1700000000}}, nil},
+		{"several series and samples", append(
+			prometheusTimeSeries([][2]string{{"__name__", "http_requests_total"}, {"path", "/api"}, {"code", "200"}}, prometheusSampleField(5, 1700000000000), prometheusSampleField(6, 1700000015000)),
+			prometheusTimeSeries([][2]string{{"instance", "host:9100"}, {"__name__", "node_load1"}}, prometheusSampleField(0.5, 1700000000999))...),
+			[]metricMessage{
+				{metricPath: "http_requests_total;code=200;path=_api", value: 5, timestamp: 1700000000},
+				{metricPath: "http_requests_total;code=200;path=_api", value: 6, timestamp: 1700000015},
+				{metricPath: "node_load1;instance=host:9100", value: 0.5, timestamp: 1700000000},
+			}, nil},
+		{"empty label left out", prometheusTimeSeries([][2]string{{"__name__", "up"}, {"job", ""}}, prometheusSampleField(1, 1700000000000)),
+			[]metricMessage{{metricPath: "up", value: 1, timestamp: 1700000000}}, nil},
+		{"staleness marker", prometheusTimeSeries([][2]string{{"__name__", "up"}}, prometheusSampleField(math.NaN(), 1700000000000)), nil, nil},
+		{"metadata and unknown fields", append(append(protobufMessageField(3, protobufStringField(2, "up")), protobufVarintField(9, 1)...),
+			prometheusTimeSeries([][2]string{{"__name__", "up"}}, prometheusSampleField(1, 1700000000000), protobufVarintField(5, 1))...),
+			[]metricMessage{{metricPath: "up", value: 1, timestamp: 1700000000}}, nil},
+		{"missing name", prometheusTimeSeries([][2]string{{"job", "node"}}, prometheusSampleField(1, 1700000000000), prometheusSampleField(2, 1700000015000)),
+			nil, []CounterId{PrometheusInvalidSample, PrometheusInvalidSample}},
+		{"infinite value", prometheusTimeSeries([][2]string{{"__name__", "up"}}, prometheusSampleField(math.Inf(1), 1700000000000)),
+			nil, []CounterId{InvalidMessageNonFiniteValue}},
+	}
+	for _, test := range tests {
+		messages, invalidSamples, err := converter.convertWriteRequest(test.data)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var invalid []CounterId
+		for _, invalidSample := range invalidSamples {
+			invalid = append(invalid, invalidSample.reason)
+		}
+		if !reflect.DeepEqual(messages, test.expected) || !reflect.DeepEqual(invalid, test.invalid) {
+			t.Errorf("%s: got %v with invalid %v, expected %v with invalid %v", test.name, messages, invalid, test.expected, test.invalid)
+		}
+	}
+}
+
+func TestConvertWriteRequestErrors(t *testing.T) {
+	converter, err := newPrometheusConverter(PrometheusMetricPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"truncated write request", prometheusWriteRequestFixture[:20]},
+		{"truncated sample", prometheusWriteRequestFixture[:len(prometheusWriteRequestFixture)-1]},
+		{"malformed key", "\x80"},
+		{"malformed timestamp", "\x0a\x04\x12\x02\x10\x80"},
+		{"truncated value", "\x0a\x06\x12\x04\x09\x00\x00\x00"},
+		{"truncated label", "\x0a\x04\x0a\x02\x0a\x05"},
+		{"unsupported wire type", "\x0b"},
+	}
+	for _, test := range tests {
+		if messages, _, err := converter.convertWriteRequest([]byte(test.data)); err == nil {
+			t.Errorf("%s: got %v, expected an error", test.name, messages)
+		}
+	}
+}
+
+func TestPrometheusHandleHttpRequest(t *testing.T) {
+	defer func(maxBodySize int64) { *httpMaxBodySize = maxBodySize }(*httpMaxBodySize)
+	*httpMaxBodySize = 1000
+	converter, err := newPrometheusConverter(PrometheusMetricPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := prometheusTimeSeries([][2]string{{"__name__", string(bytes.Repeat([]byte("x"), 1000))}}, prometheusSampleField(1, 1700000000000))
+	tests := []struct {
+		name     string
+		method   string
+		body     []byte
+		status   int
+		messages int
+	}{
+		{"fixture", http.MethodPost, snappy.Encode(nil, []byte(prometheusWriteRequestFixture)), http.StatusNoContent, 1},
+		{"GET", http.MethodGet, nil, http.StatusMethodNotAllowed, 0},
+		{"not snappy", http.MethodPost, []byte(prometheusWriteRequestFixture), http.StatusBadRequest, 0},
+		{"corrupt snappy", http.MethodPost, snappy.Encode(nil, []byte(prometheusWriteRequestFixture))[:20], http.StatusBadRequest, 0},
+		{"decoded body too large", http.MethodPost, snappy.Encode(nil, large), http.StatusBadRequest, 0},
+		{"compressed body too large", http.MethodPost, bytes.Repeat([]byte{0}, 1001), http.StatusBadRequest, 0},
+		{"invalid protobuf", http.MethodPost, snappy.Encode(nil, []byte(prometheusWriteRequestFixture[:20])), http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		incomingMessageChannel := make(chan metricMessage, 10)
+		recorder := httptest.NewRecorder()
+		converter.handleHttpRequest(recorder, httptest.NewRequest(test.method, PrometheusHttpPath, bytes.NewReader(test.body)), messageOrigin{}, incomingMessageChannel)
+		if recorder.Code != test.status || len(incomingMessageChannel) != test.messages {
+			t.Errorf("%s: got status %d and %d messages, expected status %d and %d messages", test.name, recorder.Code, len(incomingMessageChannel), test.status, test.messages)
+		}
+	}
+}
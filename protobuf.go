@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Protobuf wire types
+const (
+	ProtobufVarint          = 0
+	ProtobufFixed64         = 1
+	ProtobufLengthDelimited = 2
+	ProtobufFixed32         = 5
+)
+
+var errProtobufTruncated = errors.New("Truncated protobuf message")
+
+// protobufReader decodes the protobuf wire format directly, which is all that's needed
+// for the handful of message types used by the remote write and OTLP receivers
+type protobufReader struct {
+	data []byte
+}
+
+func (reader *protobufReader) done() bool {
+	return len(reader.data) == 0
+}
+
+// next reads the key of the next field
+func (reader *protobufReader) next() (int, int, error) {
+	key, err := reader.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(key >> 3), int(key & 7), nil
+}
+
+func (reader *protobufReader) varint() (uint64, error) {
+	value, length := binary.Uvarint(reader.data)
+	if length <= 0 {
+		return 0, errProtobufTruncated
+	}
+	reader.data = reader.data[length:]
+	return value, nil
+}
+
+func (reader *protobufReader) fixed64() (uint64, error) {
+	if len(reader.data) < 8 {
+		return 0, errProtobufTruncated
+	}
+	value := binary.LittleEndian.Uint64(reader.data)
+	reader.data = reader.data[8:]
+	return value, nil
+}
+
+func (reader *protobufReader) double() (float64, error) {
+	value, err := reader.fixed64()
+	return math.Float64frombits(value), err
+}
+
+func (reader *protobufReader) bytes() ([]byte, error) {
+	length, err := reader.varint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(reader.data)) {
+		return nil, errProtobufTruncated
+	}
+	value := reader.data[:length]
+	reader.data = reader.data[length:]
+	return value, nil
+}
+
+func (reader *protobufReader) message() (*protobufReader, error) {
+	data, err := reader.bytes()
+	return &protobufReader{data: data}, err
+}
+
+func (reader *protobufReader) string() (string, error) {
+	data, err := reader.bytes()
+	return string(data), err
+}
+
+// skip discards the value of a field that isn't needed
+func (reader *protobufReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case ProtobufVarint:
+		_, err = reader.varint()
+	case ProtobufFixed64:
+		_, err = reader.fixed64()
+	case ProtobufLengthDelimited:
+		_, err = reader.bytes()
+	case ProtobufFixed32:
+		if len(reader.data) < 4 {
+			return errProtobufTruncated
+		}
+		reader.data = reader.data[4:]
+	default:
+		return errors.New("Unsupported protobuf wire type")
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// The helpers encode protobuf fields for the tests of the remote write and OTLP receivers
+
+func protobufKey(fieldNumber int, wireType int) []byte {
+	return binary.AppendUvarint(nil, uint64(fieldNumber<<3|wireType))
+}
+
+func protobufVarintField(fieldNumber int, value uint64) []byte {
+	return binary.AppendUvarint(protobufKey(fieldNumber, ProtobufVarint), value)
+}
+
+func protobufDoubleField(fieldNumber int, value float64) []byte {
+	return binary.LittleEndian.AppendUint64(protobufKey(fieldNumber, ProtobufFixed64), math.Float64bits(value))
+}
+
+func protobufFixed64Field(fieldNumber int, value uint64) []byte {
+	return binary.LittleEndian.AppendUint64(protobufKey(fieldNumber, ProtobufFixed64), value)
+}
+
+// protobufMessageField encodes the concatenation of the parts as a length delimited field
+func protobufMessageField(fieldNumber int, parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	field := binary.AppendUvarint(protobufKey(fieldNumber, ProtobufLengthDelimited), uint64(len(data)))
+	return append(field, data...)
+}
+
+func protobufStringField(fieldNumber int, value string) []byte {
+	return protobufMessageField(fieldNumber, []byte(value))
+}
+
+func TestProtobufReader(t *testing.T) {
+	data := protobufVarintField(1, 300)
+	data = append(data, protobufDoubleField(2, 1.5)...)
+	data = append(data, protobufStringField(3, "abc")...)
+	data = append(data, protobufKey(4, ProtobufFixed32)...)
+	data = append(data, 1, 2, 3, 4)
+	data = append(data, protobufVarintField(5, 7)...)
+	reader := &protobufReader{data: data}
+
+	if fieldNumber, wireType, err := reader.next(); fieldNumber != 1 || wireType != ProtobufVarint || err != nil {
+		t.Fatalf("got field %d with wire type %d and error %v, expected field 1", fieldNumber, wireType, err)
+	}
+	if value, err := reader.varint(); value != 300 || err != nil {
+		t.Errorf("got varint %d and error %v, expected 300", value, err)
+	}
+	if fieldNumber, wireType, err := reader.next(); fieldNumber != 2 || wireType != ProtobufFixed64 || err != nil {
+		t.Fatalf("got field %d with wire type %d and error %v, expected field 2", fieldNumber, wireType, err)
+	}
+	if value, err := reader.double(); value != 1.5 || err != nil {
+		t.Errorf("got double %v and error %v, expected 1.5", value, err)
+	}
+	if fieldNumber, wireType, err := reader.next(); fieldNumber != 3 || wireType != ProtobufLengthDelimited || err != nil {
+		t.Fatalf("got field %d with wire type %d and error %v, expected field 3", fieldNumber, wireType, err)
+	}
+	if value, err := reader.string(); value != "abc" || err != nil {
+		t.Errorf("got string %q and error %v, expected abc", value, err)
+	}
+	if _, wireType, err := reader.next(); err != nil || reader.skip(wireType) != nil {
+		t.Fatalf("failed to skip field 4: %v", err)
+	}
+	if fieldNumber, _, err := reader.next(); fieldNumber != 5 || err != nil {
+		t.Fatalf("got field %d and error %v, expected field 5", fieldNumber, err)
+	}
+	if value, err := reader.varint(); value != 7 || err != nil || !reader.done() {
+		t.Errorf("got varint %d and error %v with %d bytes left, expected 7 at the end", value, err, len(reader.data))
+	}
+}
+
+func TestProtobufReaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		read func(reader *protobufReader) error
+	}{
+		{"empty varint", "", func(reader *protobufReader) error { _, err := reader.varint(); return err }},
+		{"unterminated varint", "\x80\x80", func(reader *protobufReader) error { _, err := reader.varint(); return err }},
+		{"varint over 64 bits", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\x02", func(reader *protobufReader) error { _, err := reader.varint(); return err }},
+		{"truncated fixed64", "\x00\x00\x00\x00\x00\x00\xf0", func(reader *protobufReader) error { _, err := reader.double(); return err }},
+		{"truncated bytes", "\x05abc", func(reader *protobufReader) error { _, err := reader.bytes(); return err }},
+		{"bytes with malformed length", "\x80", func(reader *protobufReader) error { _, err := reader.bytes(); return err }},
+		{"skip truncated fixed32", "\x00\x00\x00", func(reader *protobufReader) error { return reader.skip(ProtobufFixed32) }},
+		{"skip group", "", func(reader *protobufReader) error { return reader.skip(3) }},
+	}
+	for _, test := range tests {
+		if err := test.read(&protobufReader{data: []byte(test.data)}); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
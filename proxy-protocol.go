@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProxyProtocolHeaderTimeout = 5 * time.Second
+	ProxyProtocolV1MaxLength   = 107 // Including the trailing CRLF, as specified by HAProxy
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolListener expects every accepted connection to start with a PROXY protocol v1 or v2 header
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (listener proxyProtocolListener) Accept() (net.Conn, error) {
+	connection, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: connection, reader: bufio.NewReader(connection)}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header on first use, rather than in Accept, so that
+// a slow client doesn't hold up the listener. RemoteAddr then returns the real source address.
+type proxyProtocolConn struct {
+	net.Conn
+	reader        *bufio.Reader
+	once          sync.Once
+	sourceAddress net.Addr
+	err           error
+	readDeadline  time.Time // Set by the user of the connection, like the idle timeout, and restored after the header
+}
+
+func (connection *proxyProtocolConn) SetReadDeadline(deadline time.Time) error {
+	connection.readDeadline = deadline
+	return connection.Conn.SetReadDeadline(deadline)
+}
+
+func (connection *proxyProtocolConn) SetDeadline(deadline time.Time) error {
+	connection.readDeadline = deadline
+	return connection.Conn.SetDeadline(deadline)
+}
+
+// readHeader allows at most ProxyProtocolHeaderTimeout for the header, or less if the read deadline is earlier
+func (connection *proxyProtocolConn) readHeader() error {
+	connection.once.Do(func() {
+		headerDeadline := time.Now().Add(ProxyProtocolHeaderTimeout)
+		if !connection.readDeadline.IsZero() && connection.readDeadline.Before(headerDeadline) {
+			headerDeadline = connection.readDeadline
+		}
+		connection.Conn.SetReadDeadline(headerDeadline)
+		connection.sourceAddress, connection.err = parseProxyProtocolHeader(connection.reader)
+		connection.Conn.SetReadDeadline(connection.readDeadline)
+		if connection.err != nil {
+			counterData[ProxyProtocolError]++
+			log.Println("Invalid PROXY protocol header from", connection.Conn.RemoteAddr().String()+":", connection.err.Error())
+		}
+	})
+	return connection.err
+}
+
+func (connection *proxyProtocolConn) Read(buffer []byte) (int, error) {
+	if err := connection.readHeader(); err != nil {
+		return 0, err
+	}
+	return connection.reader.Read(buffer)
+}
+
+// RemoteAddr returns the source address from the header, or the proxy's own address for
+// LOCAL connections like health checks, and for address families that can't be represented
+func (connection *proxyProtocolConn) RemoteAddr() net.Addr {
+	if connection.readHeader() == nil && connection.sourceAddress != nil {
+		return connection.sourceAddress
+	}
+	return connection.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads the PROXY protocol header, if the listener expects one, and returns any error
+func readProxyProtocolHeader(connection net.Conn) error {
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		connection = tlsConnection.NetConn()
+	}
+	if proxyConnection, ok := connection.(*proxyProtocolConn); ok {
+		return proxyConnection.readHeader()
+	}
+	return nil
+}
+
+func parseProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(signature, proxyProtocolV2Signature) {
+		return parseProxyProtocolV2Header(reader)
+	}
+	if bytes.HasPrefix(signature, []byte("PROXY ")) {
+		return parseProxyProtocolV1Header(reader)
+	}
+	return nil, errors.New("Missing PROXY protocol header")
+}
+
+// parseProxyProtocolV1Header parses the text header, like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 2003\r\n"
+func parseProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= ProxyProtocolV1MaxLength {
+			return nil, errors.New("Too long PROXY protocol v1 header")
+		}
+		character, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, character)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("Invalid PROXY protocol v1 header")
+	}
+	sourceIp := net.ParseIP(fields[2])
+	sourcePort, err := strconv.ParseUint(fields[4], 10, 16)
+	if sourceIp == nil || err != nil || (sourceIp.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, errors.New("Invalid address in PROXY protocol v1 header")
+	}
+	return &net.TCPAddr{IP: sourceIp, Port: int(sourcePort)}, nil
+}
+
+// parseProxyProtocolV2Header parses the binary header. TLVs are skipped.
+func parseProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("Unsupported PROXY protocol version")
+	}
+	addresses := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, addresses); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errors.New("Invalid PROXY protocol v2 command")
+	}
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		if len(addresses) < 12 {
+			return nil, errors.New("Truncated PROXY protocol v2 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	case 2: // AF_INET6
+		if len(addresses) < 36 {
+			return nil, errors.New("Truncated PROXY protocol v2 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProxyProtocolHeader(t *testing.T) {
+	v2Signature := string(proxyProtocolV2Signature)
+	tests := []struct {
+		name    string
+		header  string
+		address string // Empty when the connection's own address is to be used
+		isError bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 2003\r\n", "192.0.2.1:56324", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 2003\r\n", "[2001:db8::1]:56324", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN 192.0.2.1 192.0.2.2 56324 2003\r\n", "", false},
+		{"v1 longest", "PROXY TCP6 ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n", "[ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff]:65535", false},
+		{"v1 too long", "PROXY UNKNOWN " + strings.Repeat("x", ProxyProtocolV1MaxLength) + "\r\n", "", true},
+		{"v1 without CRLF", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 2003\n", "", true},
+		{"v1 IPv6 address for TCP4", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 2003\r\n", "", true},
+		{"v1 IPv4 address for TCP6", "PROXY TCP6 192.0.2.1 192.0.2.2 56324 2003\r\n", "", true},
+		{"v1 invalid port", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 2003\r\n", "", true},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "", true},
+		{"v1 unknown protocol", "PROXY UDP4 192.0.2.1 192.0.2.2 56324 2003\r\n", "", true},
+		{"v2 TCP4", v2Signature + "\x21\x11\x00\x0c\xc0\x00\x02\x01\xc0\x00\x02\x02\xdc\x04\x07\xd3", "192.0.2.1:56324", false},
+		{"v2 TCP6", v2Signature + "\x21\x21\x00\x24\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\xdc\x04\x07\xd3", "[2001:db8::1]:56324", false},
+		{"v2 TCP4 with TLV", v2Signature + "\x21\x11\x00\x10\xc0\x00\x02\x01\xc0\x00\x02\x02\xdc\x04\x07\xd3\x04\x00\x01\x00", "192.0.2.1:56324", false},
+		{"v2 LOCAL", v2Signature + "\x20\x00\x00\x00", "", false},
+		{"v2 unix socket", v2Signature + "\x21\x31\x00\x00", "", false},
+		{"v2 version 1", v2Signature + "\x11\x11\x00\x0c\xc0\x00\x02\x01\xc0\x00\x02\x02\xdc\x04\x07\xd3", "", true},
+		{"v2 unknown command", v2Signature + "\x22\x11\x00\x0c\xc0\x00\x02\x01\xc0\x00\x02\x02\xdc\x04\x07\xd3", "", true},
+		{"v2 truncated addresses", v2Signature + "\x21\x11\x00\x04\xc0\x00\x02\x01", "", true},
+		{"v2 truncated header", v2Signature + "\x21\x11\x00\x0c\xc0\x00", "", true},
+		{"missing header", "carbon.agents.host1.cpuUsage 1 1700000000\n", "", true},
+		{"empty", "", "", true},
+	}
+	for _, test := range tests {
+		address, err := parseProxyProtocolHeader(bufio.NewReader(strings.NewReader(test.header)))
+		if test.isError {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if (address == nil && test.address != "") || (address != nil && address.String() != test.address) {
+			t.Errorf("%s: got address %v, expected %q", test.name, address, test.address)
+		}
+	}
+}
+
+// The messages after the header are read as usual, from the same buffered reader
+func TestProxyProtocolConnRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	connection := &proxyProtocolConn{Conn: server, reader: bufio.NewReader(server)}
+	defer connection.Close()
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 2003\r\na.b 1 1700000000\n"))
+
+	line, err := bufio.NewReader(connection).ReadString('\n')
+	if err != nil || line != "a.b 1 1700000000\n" {
+		t.Errorf("got line %q and error %v", line, err)
+	}
+	if address := connection.RemoteAddr().String(); address != "192.0.2.1:56324" {
+		t.Errorf("got remote address %s", address)
+	}
+}
+
+// The read deadline that was set before the header was read, like the idle timeout, still applies after it
+func TestProxyProtocolConnRestoresReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	connection := &proxyProtocolConn{Conn: server, reader: bufio.NewReader(server)}
+	defer connection.Close()
+	connection.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	readError := make(chan error, 1)
+	go func() {
+		_, err := connection.Read(make([]byte, 1))
+		readError <- err
+	}()
+	select {
+	case err := <-readError:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got error %v, expected the read deadline to be exceeded", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("read deadline was cleared after the header")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SpoolSegmentSuffix = ".spool"
+	SpoolPollInterval  = 100 * time.Millisecond // How often an idle spool checks for messages to replay
+)
+
+// Dots are kept, but colons and brackets in addresses are replaced in the spool directory names
+var spoolDisallowedCharacters = regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+
+// diskSpool stores the messages for a destination in segment files while its channel is full or it can't be reached.
+// Once a message has been spooled, all the messages after it are spooled too until the spool has been replayed,
+// so that the destination receives them in order.
+type diskSpool struct {
+	directory string
+	mutex     sync.Mutex
+	active    bool    // Messages are written to the spool instead of to the channel
+	segments  []int64 // Sequence numbers of the segment files, oldest first. The last one is being written if writer is set.
+	size      int64   // Bytes in all the segment files
+	writer    *bufio.Writer
+	file      *os.File
+	fileSize  int64
+	lastError string
+}
+
+func segmentFilename(directory string, sequence int64) string {
+	return filepath.Join(directory, fmt.Sprintf("%015d", sequence)+SpoolSegmentSuffix)
+}
+
+// spoolDirectoryName is where a destination is spooled. The pool is part of the name, since the same destination may be
+// in more than one pool.
+func spoolDirectoryName(pool int, destination outgoingDestination) string {
+	return filepath.Join(*spoolDirectory, strconv.Itoa(pool)+"-"+spoolDisallowedCharacters.ReplaceAllString(destination.hostPort, "_"))
+}
+
+// newDiskSpool creates the spool directory if needed. Segments left from before a restart are replayed first.
+func newDiskSpool(directory string) (*diskSpool, error) {
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	spool := &diskSpool{directory: directory}
+	for _, entry := range entries {
+		sequence, err := strconv.ParseInt(strings.TrimSuffix(entry.Name(), SpoolSegmentSuffix), 10, 64)
+		if err != nil || !strings.HasSuffix(entry.Name(), SpoolSegmentSuffix) {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		spool.segments = append(spool.segments, sequence)
+		spool.size += fileInfo.Size()
+	}
+	sort.Slice(spool.segments, func(i, j int) bool { return spool.segments[i] < spool.segments[j] })
+	spool.active = len(spool.segments) > 0
+	gaugeData[SpoolBytes] += spool.size
+	return spool, nil
+}
+
+// write sends a message to the channel, unless the spool is active, the channel is full or the destination is down
+func (spool *diskSpool) write(queue *outgoingQueue, message metricMessage) {
+	spool.mutex.Lock()
+	defer spool.mutex.Unlock()
+	if !spool.active {
+		if !queue.down.Load() {
+			select {
+			case queue.channel <- message:
+				return
+			default:
+				if channelBufferMetricsEnabled {
+					counterData[ToOutConnectionOverflows]++
+				}
+			}
+		}
+		spool.active = true
+	}
+
+	record := []byte(message.metricPath)
+	record = append(record, ' ')
+	record = strconv.AppendFloat(record, message.value, 'g', -1, 64)
+	record = append(record, ' ')
+	record = strconv.AppendInt(record, message.timestamp, 10)
+	record = append(record, '\n')
+	if spool.size+int64(len(record)) > *spoolMaxSize {
+		counterData[SpoolDropped]++
+		recordDroppedMessage(SpoolDropped, message)
+		return
+	}
+	if err := spool.append(record); err != nil {
+		counterData[SpoolDropped]++
+		recordDroppedMessage(SpoolDropped, message)
+		// Only log when the error changes, so that a full disk doesn't flood the log
+		if err.Error() != spool.lastError {
+			log.Println("Failed to write to spool", spool.directory+":", err.Error())
+			spool.lastError = err.Error()
+		}
+		return
+	}
+	spool.lastError = ""
+	counterData[SpoolWritten]++
+}
+
+// append writes a record to the newest segment, and starts a new segment when it has reached -spoolsegmentsize
+func (spool *diskSpool) append(record []byte) error {
+	if spool.writer == nil || spool.fileSize >= *spoolSegmentSize {
+		if err := spool.closeSegment(); err != nil {
+			return err
+		}
+		sequence := int64(0)
+		if len(spool.segments) > 0 {
+			sequence = spool.segments[len(spool.segments)-1] + 1
+		}
+		file, err := os.OpenFile(segmentFilename(spool.directory, sequence), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		spool.segments = append(spool.segments, sequence)
+		spool.file = file
+		spool.fileSize = 0
+		spool.writer = bufio.NewWriter(file)
+	}
+	length, err := spool.writer.Write(record)
+	spool.fileSize += int64(length)
+	spool.size += int64(length)
+	gaugeData[SpoolBytes] += int64(length)
+	return err
+}
+
+func (spool *diskSpool) closeSegment() error {
+	if spool.writer == nil {
+		return nil
+	}
+	err := spool.writer.Flush()
+	if closeErr := spool.file.Close(); err == nil {
+		err = closeErr
+	}
+	spool.writer = nil
+	spool.file = nil
+	return err
+}
+
+// removeOldestSegment is called once the oldest segment has been replayed
+func (spool *diskSpool) removeOldestSegment(fileSize int64) error {
+	if len(spool.segments) == 1 {
+		if err := spool.closeSegment(); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(segmentFilename(spool.directory, spool.segments[0])); err != nil {
+		return err
+	}
+	spool.segments = spool.segments[1:]
+	spool.size -= fileSize
+	gaugeData[SpoolBytes] -= fileSize
+	return nil
+}
+
+// parseSpooledMessage reads a line written by write. The path is everything before the last two fields.
+func parseSpooledMessage(line string) (metricMessage, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return metricMessage{}, errors.New("Invalid spooled message: \"" + line + "\"")
+	}
+	value, err := strconv.ParseFloat(fields[len(fields)-2], 64)
+	if err != nil {
+		return metricMessage{}, err
+	}
+	timestamp, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return metricMessage{}, err
+	}
+	return metricMessage{metricPath: strings.Join(fields[:len(fields)-2], " "), value: value, timestamp: timestamp}, nil
+}
+
+// replay sends the spooled messages to the channel, at most maxRate per second, whenever the destination is up.
+// When everything has been replayed, messages are written directly to the channel again.
+func (spool *diskSpool) replay(queue *outgoingQueue, maxRate int) {
+	var file *os.File
+	var reader *bufio.Reader
+	var line []byte
+	var replayedSize int64 // Bytes read from the segment being replayed
+	var windowStart time.Time
+	replayedInWindow := 0
+	for {
+		if queue.down.Load() {
+			// Nothing is replayed meanwhile, so write out the buffered messages in case hadrianus is restarted
+			spool.mutex.Lock()
+			if spool.writer != nil {
+				spool.writer.Flush()
+			}
+			spool.mutex.Unlock()
+			time.Sleep(SpoolPollInterval)
+			continue
+		}
+		if reader == nil {
+			spool.mutex.Lock()
+			if len(spool.segments) == 0 {
+				spool.active = false
+				spool.mutex.Unlock()
+				time.Sleep(SpoolPollInterval)
+				continue
+			}
+			var err error
+			file, err = os.Open(segmentFilename(spool.directory, spool.segments[0]))
+			spool.mutex.Unlock()
+			if err != nil {
+				log.Println("Failed to replay spool", spool.directory+":", err.Error())
+				time.Sleep(time.Second)
+				continue
+			}
+			reader = bufio.NewReader(file)
+			replayedSize = 0
+		}
+
+		fragment, err := reader.ReadBytes('\n')
+		line = append(line, fragment...)
+		replayedSize += int64(len(fragment))
+		if err == io.EOF {
+			spool.mutex.Lock()
+			// Records may have been written since the end of the file was reached, even to a segment that has been
+			// closed since, and a record may be partly in the file and partly in the writer's buffer
+			if len(spool.segments) == 1 && spool.writer != nil && spool.writer.Buffered() > 0 {
+				err = spool.writer.Flush()
+				if err != nil {
+					spool.mutex.Unlock()
+					log.Println("Failed to write to spool", spool.directory+":", err.Error())
+					time.Sleep(time.Second)
+					continue
+				}
+			}
+			fileInfo, err := file.Stat()
+			if err == nil && replayedSize < fileInfo.Size() {
+				spool.mutex.Unlock()
+				continue
+			}
+			// The whole segment has been replayed. A partial line can only be left by a crash, and is dropped.
+			if len(line) > 0 {
+				counterData[SpoolDropped]++
+				recordDeadLetter(SpoolDropped, messageOrigin{}, string(line))
+				line = nil
+			}
+			if err == nil {
+				err = spool.removeOldestSegment(fileInfo.Size())
+			}
+			if err != nil {
+				log.Println("Failed to remove replayed spool segment in", spool.directory+":", err.Error())
+				os.Exit(1)
+			}
+			spool.mutex.Unlock()
+			file.Close()
+			file = nil
+			reader = nil
+			continue
+		}
+		if err != nil {
+			log.Println("Failed to replay spool", spool.directory+":", err.Error())
+			os.Exit(1)
+		}
+
+		message, err := parseSpooledMessage(string(line))
+		if err != nil {
+			counterData[SpoolDropped]++
+			recordDeadLetter(SpoolDropped, messageOrigin{}, strings.TrimRight(string(line), "\n"))
+			line = nil
+			continue
+		}
+		line = nil
+		if maxRate > 0 {
+			if now := time.Now(); now.Sub(windowStart) >= time.Second {
+				windowStart = now
+				replayedInWindow = 0
+			} else if replayedInWindow >= maxRate {
+				time.Sleep(time.Until(windowStart.Add(time.Second)))
+				windowStart = time.Now()
+				replayedInWindow = 0
+			}
+			replayedInWindow++
+		}
+		queue.channel <- message
+		counterData[SpoolReplayed]++
+	}
+}
+
+// waitUntilReplayed returns once everything in the spool has been sent to the channel
+func (spool *diskSpool) waitUntilReplayed() {
+	for {
+		spool.mutex.Lock()
+		active := spool.active
+		spool.mutex.Unlock()
+		if !active {
+			return
+		}
+		time.Sleep(SpoolPollInterval)
+	}
+}
+
+func validateSpoolFlags() error {
+	if *spoolMaxSize < 1 || *spoolSegmentSize < 1 {
+		return errors.New("-spoolmaxsize and -spoolsegmentsize must be at least 1")
+	}
+	if *spoolReplayRate < 0 {
+		return errors.New("Invalid value for -spoolreplayrate: " + strconv.Itoa(*spoolReplayRate))
+	}
+	return nil
+}
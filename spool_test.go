@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSpooledMessage(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected metricMessage
+		isError  bool
+	}{
+		{"a.b 1.5 1700000000\n", metricMessage{metricPath: "a.b", value: 1.5, timestamp: 1700000000}, false},
+		{"a.b;tag=x -2 1700000000\n", metricMessage{metricPath: "a.b;tag=x", value: -2, timestamp: 1700000000}, false},
+		{"a.b 1.5\n", metricMessage{}, true},
+		{"a.b x 1700000000\n", metricMessage{}, true},
+		{"a.b 1.5 x\n", metricMessage{}, true},
+	}
+	for _, test := range tests {
+		message, err := parseSpooledMessage(test.line)
+		if (err != nil) != test.isError || message != test.expected {
+			t.Errorf("%q: got %v and error %v, expected %v", test.line, message, err, test.expected)
+		}
+	}
+}
+
+// Records of 4096 bytes or more bypass the buffer of the segment writer, and records keep being spooled while
+// the spool is replayed. Every message has to be replayed exactly once, in order, across several segments.
+func TestSpoolReplay(t *testing.T) {
+	defer func(segmentSize int64) { *spoolSegmentSize = segmentSize }(*spoolSegmentSize)
+	*spoolSegmentSize = 20000
+
+	spool, err := newDiskSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := &outgoingQueue{channel: make(chan metricMessage, 1), spool: spool}
+	var messages []metricMessage
+	for i := 0; i < 200; i++ {
+		path := "spooled." + strconv.Itoa(i)
+		switch i % 4 {
+		case 1:
+			path += "." + strings.Repeat("x", 5000)
+		case 3:
+			path += "." + strings.Repeat("y", 70000)
+		}
+		messages = append(messages, metricMessage{metricPath: path, value: float64(i), timestamp: 1700000000 + int64(i)})
+	}
+
+	// The first half is spooled while the destination is down, and the second half while it is being replayed
+	queue.down.Store(true)
+	for _, message := range messages[:100] {
+		queue.write(message)
+	}
+	queue.down.Store(false)
+	go spool.replay(queue, 0)
+	go func() {
+		for _, message := range messages[100:] {
+			queue.write(message)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for i, expected := range messages {
+		select {
+		case message := <-queue.channel:
+			if message != expected {
+				t.Fatalf("message %d: got %.40s, expected %.40s", i, message.metricPath, expected.metricPath)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message %d was never replayed", i)
+		}
+	}
+	spool.waitUntilReplayed()
+	select {
+	case message := <-queue.channel:
+		t.Errorf("got an extra message %.40s", message.metricPath)
+	default:
+	}
+}
+
+// A record that is written after the replay has reached the end of the segment, but before it has taken the lock,
+// has to be replayed. A large record is written straight to the file, so the writer's buffer stays empty.
+func TestSpoolReplayRecordWrittenAtEndOfSegment(t *testing.T) {
+	spool, err := newDiskSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := &outgoingQueue{channel: make(chan metricMessage), spool: spool}
+	queue.down.Store(true)
+	first := metricMessage{metricPath: "spooled.first", value: 1, timestamp: 1700000000}
+	queue.write(first)
+	spool.mutex.Lock()
+	spool.writer.Flush()
+	spool.mutex.Unlock()
+
+	// The replay reads the first message and waits to send it
+	queue.down.Store(false)
+	go spool.replay(queue, 0)
+	time.Sleep(100 * time.Millisecond)
+	spool.mutex.Lock()
+	if message := <-queue.channel; message != first {
+		t.Fatalf("got %v, expected %v", message, first)
+	}
+	// Give the replay time to reach the end of the segment and wait for the lock
+	time.Sleep(100 * time.Millisecond)
+	large := metricMessage{metricPath: "spooled." + strings.Repeat("x", 5000), value: 2, timestamp: 1700000001}
+	err = spool.append([]byte(large.metricPath + " 2 1700000001\n"))
+	buffered := spool.writer.Buffered()
+	spool.mutex.Unlock()
+	if err != nil || buffered != 0 {
+		t.Fatalf("got error %v and %d buffered bytes after writing a large record", err, buffered)
+	}
+
+	select {
+	case message := <-queue.channel:
+		if message != large {
+			t.Errorf("got %.40s, expected %.40s", message.metricPath, large.metricPath)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the large record was never replayed")
+	}
+}
@@ -14,7 +14,14 @@ type CounterId int
 const (
 	CleanupTimeMilli CounterId = iota
 	ClientConnectionClosing
+	ClientConnectionIdleTimeout
+	ClientConnectionLimitReached
 	ClientConnectionOpening
+	ClientConnectionReadTimeout
+	ClientConnectionSourceLimitReached
+	DeadLetterDropped
+	DeadLetterWritten
+	DecompressionError
 	DiscardedChattyMessage
 	DiscardedStaleAndChattyMessage
 	DiscardedStaleMessage
@@ -23,16 +30,54 @@ const (
 	DroppedOutConnection
 	GarbageCollectionPauseMs
 	GarbageCollections
+	HttpRequest
+	HttpRequestRejected
 	IncomingMessageOverflows
+	InfluxInvalidLine
+	InfluxReceivedLine
 	InvalidMessage
+	InvalidMessageEmptyPath
+	InvalidMessageFieldCount
+	InvalidMessageNonFiniteValue
+	InvalidMessagePathCharacter
+	InvalidMessageTags
+	InvalidMessageTimestamp
+	InvalidMessageValue
+	InvalidPickleFrame
+	OtlpReceivedMetric
+	OtlpRejectedDataPoint
+	OutConnectionFailed
+	OutConnectionLost
+	OutConnectionOpened
+	OversizedLine
+	OversizedPickleFrame
+	PrometheusInvalidSample
+	PrometheusReceivedSample
+	ProxyProtocolError
 	ReceivedMessage
+	ReceivedPickleFrame
+	ReroutedMessage
 	SentMessage
+	SentPickleBatch
+	SpoolDropped
+	SpoolReplayed
+	SpoolWritten
+	StatsdDatagramReceived
+	StatsdDatagramTruncated
+	StatsdFlush
+	StatsdInvalidMessage
+	StatsdReadError
+	StatsdReceivedMessage
+	TlsHandshakeError
 	ToOutConnectionOverflows
 	ToOutPoolOverflows
+	UdpDatagramReceived
+	UdpDatagramTruncated
+	UdpReadError
 )
 
-var counterData [ToOutPoolOverflows + 1]int64
-var oldCounterData [ToOutPoolOverflows + 1]int64
+var counterData [UdpReadError + 1]int64
+var oldCounterData [UdpReadError + 1]int64
 var counterPath []string
 
 // Enums for gauges
@@ -43,6 +88,8 @@ const (
 	ClientConnectionsActive
 	EncounteredMetricPaths
 	Goroutines
+	OutConnectionsDown
+	SpoolBytes
 	StaleMetricPaths
 )
 
@@ -76,6 +123,72 @@ func generateInternalStats(incomingMessageChannel chan metricMessage) {
 	timesStatsGenerated++
 }
 
+// Names of the counters in the internal metric paths, in the same order as the CounterId enums
+var counterNames = []string{
+	`cleanupTimeMilli`,
+	`clientConnectionClosing`,
+	`clientConnectionIdleTimeout`,
+	`clientConnectionLimitReached`,
+	`clientConnectionOpening`,
+	`clientConnectionReadTimeout`,
+	`clientConnectionSourceLimitReached`,
+	`deadLetterDropped`,
+	`deadLetterWritten`,
+	`decompressionError`,
+	`discardedChattyMessage`,
+	`discardedStaleAndChattyMessage`,
+	`discardedStaleMessage`,
+	`droppedIncomingMessages`,
+	`droppedOutPool`,
+	`droppedOutConnection`,
+	`garbageCollectionPauseMs`,
+	`garbageCollections`,
+	`httpRequest`,
+	`httpRequestRejected`,
+	`incomingMessageOverflows`,
+	`influxInvalidLine`,
+	`influxReceivedLine`,
+	`invalidMessage`,
+	`invalidMessageEmptyPath`,
+	`invalidMessageFieldCount`,
+	`invalidMessageNonFiniteValue`,
+	`invalidMessagePathCharacter`,
+	`invalidMessageTags`,
+	`invalidMessageTimestamp`,
+	`invalidMessageValue`,
+	`invalidPickleFrame`,
+	`otlpReceivedMetric`,
+	`otlpRejectedDataPoint`,
+	`outConnectionFailed`,
+	`outConnectionLost`,
+	`outConnectionOpened`,
+	`oversizedLine`,
+	`oversizedPickleFrame`,
+	`prometheusInvalidSample`,
+	`prometheusReceivedSample`,
+	`proxyProtocolError`,
+	`receivedMessage`,
+	`receivedPickleFrame`,
+	`reroutedMessage`,
+	`sentMessage`,
+	`sentPickleBatch`,
+	`spoolDropped`,
+	`spoolReplayed`,
+	`spoolWritten`,
+	`statsdDatagramReceived`,
+	`statsdDatagramTruncated`,
+	`statsdFlush`,
+	`statsdInvalidMessage`,
+	`statsdReadError`,
+	`statsdReceivedMessage`,
+	`tlsHandshakeError`,
+	`toOutConnectionOverflows`,
+	`toOutPoolOverflows`,
+	`udpDatagramReceived`,
+	`udpDatagramTruncated`,
+	`udpReadError`,
+}
+
 func initializeInternalMetricsPaths(metricPathTemplate string) {
 	// Extract hostname for naming internal hadrianus metrics
 	hostname, err := os.Hostname()
@@ -85,26 +198,8 @@ func initializeInternalMetricsPaths(metricPathTemplate string) {
 		return
 	}
 
-	for _, metric := range []string{
-		`cleanupTimeMilli`,
-		`clientConnectionClosing`,
-		`clientConnectionOpening`,
-		`discardedChattyMessage`,
-		`discardedStaleAndChattyMessage`,
-		`discardedStaleMessage`,
-		`droppedIncomingMessages`,
-		`droppedOutPool`,
-		`droppedOutConnection`,
-		`garbageCollectionPauseMs`,
-		`garbageCollections`,
-		`incomingMessageOverflows`,
-		`invalidMessage`,
-		`receivedMessage`,
-		`sentMessage`,
-		`toOutConnectionOverflows`,
-		`toOutPoolOverflows`,
-	} {
-		counterPath = append(counterPath, renderTemplate(metricPathTemplate, TemplateData{hostname, metric}))
+	for _, metric := range counterNames {
+		counterPath = append(counterPath, renderTemplate(metricPathTemplate, TemplateData{Host: hostname, Metric: metric}))
 	}
 
 	for _, metric := range []string{
@@ -112,9 +207,11 @@ func initializeInternalMetricsPaths(metricPathTemplate string) {
 		`clientConnectionsActive`,
 		`encounteredMetricPaths`,
 		`goroutines`,
+		`outConnectionsDown`,
+		`spoolBytes`,
 		`staleMetricPaths`,
 	} {
-		gaugePath = append(gaugePath, renderTemplate(metricPathTemplate, TemplateData{hostname, metric}))
+		gaugePath = append(gaugePath, renderTemplate(metricPathTemplate, TemplateData{Host: hostname, Metric: metric}))
 	}
 }
 
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric types, as used in the statsd metricPath template
+const (
+	StatsdCounters = "counters"
+	StatsdGauges   = "gauges"
+	StatsdTimers   = "timers"
+	StatsdSets     = "sets"
+)
+
+type statsdAggregator struct {
+	mutex       sync.Mutex
+	counters    map[string]float64
+	gauges      map[string]float64 // Gauges keep their value between flushes, like in statsd
+	timers      map[string][]float64
+	timerCounts map[string]float64 // Sample rate adjusted number of timer values
+	sets        map[string]map[string]struct{}
+
+	metricPathTemplate *template.Template
+	host               string
+	percentiles        []float64
+	profile            *policyProfile // Profile of the listener, given to the aggregated metrics
+}
+
+// Characters that statsd removes from metric names, after replacing whitespace and slashes
+var statsdDisallowedCharacters = regexp.MustCompile(`[^a-zA-Z0-9_\-.;=]`)
+
+func newStatsdAggregator(metricPathTemplate string, percentilesText string) (*statsdAggregator, error) {
+	parsedTemplate, err := template.New("statsdMetricPath").Parse(metricPathTemplate)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	aggregator := &statsdAggregator{
+		gauges:             make(map[string]float64),
+		metricPathTemplate: parsedTemplate,
+		host:               hostname,
+	}
+	for _, percentileText := range strings.Split(percentilesText, ",") {
+		if strings.TrimSpace(percentileText) == "" {
+			continue
+		}
+		percentile, err := strconv.ParseFloat(strings.TrimSpace(percentileText), 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, errors.New("Invalid statsd percentile: \"" + percentileText + "\"")
+		}
+		aggregator.percentiles = append(aggregator.percentiles, percentile)
+	}
+	aggregator.reset()
+	return aggregator, nil
+}
+
+// reset clears everything but the gauges, which is done after each flush
+func (aggregator *statsdAggregator) reset() {
+	aggregator.counters = make(map[string]float64)
+	aggregator.timers = make(map[string][]float64)
+	aggregator.timerCounts = make(map[string]float64)
+	aggregator.sets = make(map[string]map[string]struct{})
+}
+
+// processLine aggregates a statsd line like "name:value|type[|@samplerate]". Several
+// values for the same name may be given in one line, like "name:1|c:250|ms".
+func (aggregator *statsdAggregator) processLine(line string, source string) {
+	fields := strings.Split(strings.TrimSpace(line), ":")
+	name := sanitizeStatsdName(fields[0])
+	if len(fields) < 2 || name == "" {
+		counterData[StatsdInvalidMessage]++
+		recordDeadLetter(StatsdInvalidMessage, messageOrigin{source: source}, line)
+		return
+	}
+	// Names may have graphite tags, which are normalized so that the same series is aggregated together
+	var err error
+	if name, err = normalizeMetricPath(name); err != nil {
+		counterData[StatsdInvalidMessage]++
+		countInvalidMessage(invalidMessageError{InvalidMessageTags, err.Error()})
+		recordDeadLetter(InvalidMessageTags, messageOrigin{source: source}, line)
+		return
+	}
+
+	aggregator.mutex.Lock()
+	defer aggregator.mutex.Unlock()
+	invalid := false
+	for _, valueText := range fields[1:] {
+		if err := aggregator.processValue(name, valueText); err != nil {
+			counterData[StatsdInvalidMessage]++
+			var invalidMessage invalidMessageError
+			if errors.As(err, &invalidMessage) {
+				countInvalidMessage(err)
+			}
+			invalid = true
+		} else {
+			counterData[StatsdReceivedMessage]++
+		}
+	}
+	// The line is written once, even if several of its values were invalid
+	if invalid {
+		recordDeadLetter(StatsdInvalidMessage, messageOrigin{source: source}, line)
+	}
+}
+
+func (aggregator *statsdAggregator) processValue(name string, valueText string) error {
+	parts := strings.Split(valueText, "|")
+	if len(parts) < 2 {
+		return errors.New("Missing statsd metric type")
+	}
+	sampleRate := 1.0
+	for _, part := range parts[2:] {
+		if strings.HasPrefix(part, "@") {
+			var err error
+			if sampleRate, err = strconv.ParseFloat(part[1:], 64); err != nil || sampleRate <= 0 || sampleRate > 1 {
+				return errors.New("Invalid statsd sample rate")
+			}
+		}
+		// Other extensions, like DogStatsD tags, are ignored
+	}
+
+	switch parts[1] {
+	case "c":
+		value, err := parseStatsdNumber(name, parts[0])
+		if err != nil {
+			return err
+		}
+		aggregator.counters[name] += value / sampleRate
+	case "g":
+		value, err := parseStatsdNumber(name, parts[0])
+		if err != nil {
+			return err
+		}
+		// A leading sign means that the gauge is modified instead of set
+		if strings.HasPrefix(parts[0], "+") || strings.HasPrefix(parts[0], "-") {
+			aggregator.gauges[name] += value
+		} else {
+			aggregator.gauges[name] = value
+		}
+	case "ms", "h":
+		value, err := parseStatsdNumber(name, parts[0])
+		if err != nil {
+			return err
+		}
+		aggregator.timers[name] = append(aggregator.timers[name], value)
+		aggregator.timerCounts[name] += 1 / sampleRate
+	case "s":
+		if aggregator.sets[name] == nil {
+			aggregator.sets[name] = make(map[string]struct{})
+		}
+		aggregator.sets[name][parts[0]] = struct{}{}
+	default:
+		return errors.New("Unknown statsd metric type: " + parts[1])
+	}
+	return nil
+}
+
+// parseStatsdNumber parses a value, which is also checked like the values of the other protocols
+func parseStatsdNumber(name string, text string) (float64, error) {
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, errors.New("Invalid statsd value: " + text)
+	}
+	return value, validateMetricMessage(metricMessage{metricPath: name, value: value}, "statsd message")
+}
+
+// sanitizeStatsdName cleans up a metric name the same way as statsd does
+func sanitizeStatsdName(name string) string {
+	name = strings.Join(strings.Fields(name), "_")
+	name = strings.ReplaceAll(name, "/", "-")
+	return statsdDisallowedCharacters.ReplaceAllString(name, "")
+}
+
+// flush sends the aggregated metrics of the last interval into the normal filtering pipeline
+func (aggregator *statsdAggregator) flush(incomingMessageChannel chan metricMessage, timestamp int64, flushInterval float64) {
+
+	aggregator.mutex.Lock()
+	counters, timers, timerCounts, sets := aggregator.counters, aggregator.timers, aggregator.timerCounts, aggregator.sets
+	gauges := make(map[string]float64, len(aggregator.gauges))
+	for name, value := range aggregator.gauges {
+		gauges[name] = value
+	}
+	aggregator.reset()
+	aggregator.mutex.Unlock()
+
+	// The aggregated values are checked again, since they may overflow, and the template may add disallowed characters
+	send := func(metricType string, name string, aggregate string, value float64) {
+		outputMessage := metricMessage{metricPath: aggregator.metricPath(metricType, name, aggregate), value: value, timestamp: timestamp}
+		outputMessage.profile = aggregator.profile
+		if err := validateMetricMessage(outputMessage, "aggregated statsd metric"); err != nil {
+			countInvalidMessage(err)
+			return
+		}
+		writeIncomingMessage(incomingMessageChannel, outputMessage)
+	}
+
+	for name, value := range counters {
+		send(StatsdCounters, name, ".count", value)
+		send(StatsdCounters, name, ".rate", value/flushInterval)
+	}
+	for name, value := range gauges {
+		send(StatsdGauges, name, "", value)
+	}
+	for name, values := range sets {
+		send(StatsdSets, name, ".count", float64(len(values)))
+	}
+	for name, values := range timers {
+		sort.Float64s(values)
+		count := len(values)
+		var sum, sumOfSquares float64
+		for _, value := range values {
+			sum += value
+			sumOfSquares += value * value
+		}
+		mean := sum / float64(count)
+		median := values[count/2]
+		if count%2 == 0 {
+			median = (values[count/2-1] + values[count/2]) / 2
+		}
+
+		send(StatsdTimers, name, ".count", timerCounts[name])
+		send(StatsdTimers, name, ".count_ps", timerCounts[name]/flushInterval)
+		send(StatsdTimers, name, ".lower", values[0])
+		send(StatsdTimers, name, ".upper", values[count-1])
+		send(StatsdTimers, name, ".sum", sum)
+		send(StatsdTimers, name, ".mean", mean)
+		send(StatsdTimers, name, ".median", median)
+		send(StatsdTimers, name, ".std", math.Sqrt(math.Max(sumOfSquares/float64(count)-mean*mean, 0)))
+
+		// Same naming and rounding as statsd, so "90" gives mean_90, upper_90 and sum_90
+		for _, percentile := range aggregator.percentiles {
+			suffix := strings.ReplaceAll(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_")
+			withinPercentile := int(math.Round(percentile / 100 * float64(count)))
+			if withinPercentile < 1 {
+				continue
+			}
+			var percentileSum float64
+			for _, value := range values[:withinPercentile] {
+				percentileSum += value
+			}
+			send(StatsdTimers, name, ".mean_"+suffix, percentileSum/float64(withinPercentile))
+			send(StatsdTimers, name, ".upper_"+suffix, values[withinPercentile-1])
+			send(StatsdTimers, name, ".sum_"+suffix, percentileSum)
+		}
+	}
+	counterData[StatsdFlush]++
+}
+
+// metricPath renders the template for a name followed by its aggregate, like "foo" and ".count". The tags of a
+// tagged name, like "foo;env=prod", are put at the end of the path, after the aggregate and whatever the template adds.
+func (aggregator *statsdAggregator) metricPath(metricType string, name string, aggregate string) string {
+	var tags string
+	if tagsStart := strings.IndexByte(name, ';'); tagsStart >= 0 {
+		name, tags = name[:tagsStart], name[tagsStart:]
+	}
+	var templateOutputBuffer bytes.Buffer
+	if err := aggregator.metricPathTemplate.Execute(&templateOutputBuffer, TemplateData{Host: aggregator.host, Metric: name + aggregate, Type: metricType}); err != nil {
+		panic(err)
+	}
+	return templateOutputBuffer.String() + tags
+}
+
+func createStatsdListener(listenAddress string, profile *policyProfile, incomingMessageChannel chan metricMessage) {
+	aggregator, err := newStatsdAggregator(*statsdMetricPath, *statsdPercentiles)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+		return
+	}
+	aggregator.profile = profile
+
+	go func() {
+		d := time.Duration(*statsdFlushInterval) * time.Second
+		// The tick times are rounded, so that late ticks don't make the timestamps of two flushes closer than the interval
+		for tick := range time.Tick(d) {
+			aggregator.flush(incomingMessageChannel, tick.Round(time.Second).Unix(), float64(*statsdFlushInterval))
+		}
+	}()
+
+	statsdCounters := datagramCounters{received: StatsdDatagramReceived, truncated: StatsdDatagramTruncated, readError: StatsdReadError}
+	createIncomingUdpListener(listenAddress, statsdCounters, aggregator.processLine)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// flushStatsd flushes the aggregator with a 10 second interval, and returns the values of the flushed metrics by path
+func flushStatsd(t *testing.T, aggregator *statsdAggregator) map[string]float64 {
+	incomingMessageChannel := make(chan metricMessage, 100)
+	aggregator.flush(incomingMessageChannel, 1700000000, 10)
+	close(incomingMessageChannel)
+	values := make(map[string]float64)
+	for message := range incomingMessageChannel {
+		if message.timestamp != 1700000000 || message.profile != aggregator.profile {
+			t.Errorf("%s: got timestamp %d and profile %v", message.metricPath, message.timestamp, message.profile)
+		}
+		values[message.metricPath] = message.value
+	}
+	return values
+}
+
+func TestStatsdAggregation(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		expected map[string]float64
+	}{
+		{"counter", []string{"hits:1|c", "hits:2|c"}, map[string]float64{
+			"stats.counters.hits.count": 3,
+			"stats.counters.hits.rate":  0.3,
+		}},
+		{"counter sample rate", []string{"hits:1|c|@0.1", "hits:2|c"}, map[string]float64{
+			"stats.counters.hits.count": 12,
+			"stats.counters.hits.rate":  1.2,
+		}},
+		{"gauge deltas", []string{"load:10|g", "load:+5|g", "load:-3|g"}, map[string]float64{
+			"stats.gauges.load": 12,
+		}},
+		{"gauge set after delta", []string{"load:+5|g", "load:2|g"}, map[string]float64{
+			"stats.gauges.load": 2,
+		}},
+		{"set", []string{"users:a|s", "users:b|s", "users:a|s"}, map[string]float64{
+			"stats.sets.users.count": 2,
+		}},
+		{"timer sample rate and odd count", []string{"latency:4|ms|@0.5", "latency:1|ms", "latency:1|h"}, map[string]float64{
+			"stats.timers.latency.count":    4,
+			"stats.timers.latency.count_ps": 0.4,
+			"stats.timers.latency.lower":    1,
+			"stats.timers.latency.upper":    4,
+			"stats.timers.latency.sum":      6,
+			"stats.timers.latency.mean":     2,
+			"stats.timers.latency.median":   1,
+			"stats.timers.latency.std":      math.Sqrt(2),
+			"stats.timers.latency.mean_90":  2,
+			"stats.timers.latency.upper_90": 4,
+			"stats.timers.latency.sum_90":   6,
+		}},
+		{"several values in one line", []string{"multi:1|c:250|ms"}, map[string]float64{
+			"stats.counters.multi.count":  1,
+			"stats.counters.multi.rate":   0.1,
+			"stats.timers.multi.count":    1,
+			"stats.timers.multi.count_ps": 0.1,
+			"stats.timers.multi.lower":    250,
+			"stats.timers.multi.upper":    250,
+			"stats.timers.multi.sum":      250,
+			"stats.timers.multi.mean":     250,
+			"stats.timers.multi.median":   250,
+			"stats.timers.multi.std":      0,
+			"stats.timers.multi.mean_90":  250,
+			"stats.timers.multi.upper_90": 250,
+			"stats.timers.multi.sum_90":   250,
+		}},
+		{"tags after the aggregate", []string{"req;env=prod:1|c", "req;env=prod:4|c", "temp;room=b;floor=1:20|g"}, map[string]float64{
+			"stats.counters.req.count;env=prod": 5,
+			"stats.counters.req.rate;env=prod":  0.5,
+			"stats.gauges.temp;floor=1;room=b":  20,
+		}},
+		{"sanitized name", []string{"my metric/name!:1|c"}, map[string]float64{
+			"stats.counters.my_metric-name.count": 1,
+			"stats.counters.my_metric-name.rate":  0.1,
+		}},
+		{"invalid lines", []string{"bad", ":1|c", "x:1", "x:1|q", "x:a|c", "x:1|c|@2", "x:1|c|@0", "x;tag:1|c", "x:NaN|g"}, map[string]float64{}},
+	}
+	for _, test := range tests {
+		aggregator, err := newStatsdAggregator(StatsdMetricPath, "90")
+		if err != nil {
+			t.Fatal(err)
+		}
+		aggregator.profile = &policyProfile{}
+		for _, line := range test.lines {
+			aggregator.processLine(line, "")
+		}
+		if values := flushStatsd(t, aggregator); !reflect.DeepEqual(values, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, values, test.expected)
+		}
+	}
+}
+
+func TestStatsdTimerPercentiles(t *testing.T) {
+	aggregator, err := newStatsdAggregator(StatsdMetricPath, "90, 50,99.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sent in reverse order, since the values have to be sorted
+	for value := 10; value >= 1; value-- {
+		aggregator.processLine("t:"+strconv.Itoa(value)+"|ms", "")
+	}
+	expected := map[string]float64{
+		"stats.timers.t.count":      10,
+		"stats.timers.t.count_ps":   1,
+		"stats.timers.t.lower":      1,
+		"stats.timers.t.upper":      10,
+		"stats.timers.t.sum":        55,
+		"stats.timers.t.mean":       5.5,
+		"stats.timers.t.median":     5.5,
+		"stats.timers.t.std":        math.Sqrt(8.25),
+		"stats.timers.t.mean_90":    5,
+		"stats.timers.t.upper_90":   9,
+		"stats.timers.t.sum_90":     45,
+		"stats.timers.t.mean_50":    3,
+		"stats.timers.t.upper_50":   5,
+		"stats.timers.t.sum_50":     15,
+		"stats.timers.t.mean_99_5":  5.5,
+		"stats.timers.t.upper_99_5": 10,
+		"stats.timers.t.sum_99_5":   55,
+	}
+	if values := flushStatsd(t, aggregator); !reflect.DeepEqual(values, expected) {
+		t.Errorf("got %v, expected %v", values, expected)
+	}
+}
+
+// Counters, timers and sets are only sent for the interval they were updated in, while gauges keep their value
+func TestStatsdFlushResets(t *testing.T) {
+	aggregator, err := newStatsdAggregator(StatsdMetricPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"hits:1|c", "load:10|g", "users:a|s", "latency:5|ms"} {
+		aggregator.processLine(line, "")
+	}
+	if values := flushStatsd(t, aggregator); len(values) != 12 {
+		t.Errorf("got %d metrics in the first flush, expected 12: %v", len(values), values)
+	}
+	if values := flushStatsd(t, aggregator); !reflect.DeepEqual(values, map[string]float64{"stats.gauges.load": 10}) {
+		t.Errorf("got %v in the second flush, expected only the gauge", values)
+	}
+	aggregator.processLine("load:-4|g", "")
+	if values := flushStatsd(t, aggregator); !reflect.DeepEqual(values, map[string]float64{"stats.gauges.load": 6}) {
+		t.Errorf("got %v after a gauge delta, expected the gauge at 6", values)
+	}
+}
+
+func TestNewStatsdAggregatorErrors(t *testing.T) {
+	tests := []struct {
+		metricPath  string
+		percentiles string
+	}{
+		{"stats.{{ .Type", ""},
+		{StatsdMetricPath, "x"},
+		{StatsdMetricPath, "0"},
+		{StatsdMetricPath, "101"},
+	}
+	for _, test := range tests {
+		if _, err := newStatsdAggregator(test.metricPath, test.percentiles); err == nil {
+			t.Errorf("%s with percentiles %q: expected an error", test.metricPath, test.percentiles)
+		}
+	}
+}
@@ -17,6 +17,8 @@ const DaysInYear = 365
 // Allows overriding settings on a per-metrics path level
 type overrideData struct {
 	pattern                 *regexp.Regexp
+	tags                    []tagExpression
+	clientSubject           *regexp.Regexp
 	retention               []retentionItem
 	maxDryMessagesThreshold uint64
 	allowUnmodified         bool
@@ -26,11 +28,33 @@ type overrideData struct {
 	allowUnmodifiedActive         bool
 }
 
+// matches checks the path pattern, the tag expressions and the client subject, any of which may be left out
+func (override overrideData) matches(metricPath string, client string) bool {
+	if override.pattern != nil && !override.pattern.MatchString(metricPath) {
+		return false
+	}
+	if override.clientSubject != nil && !override.clientSubject.MatchString(client) {
+		return false
+	}
+	return matchTagExpressions(override.tags, metricPath)
+}
+
 type retentionItem struct {
 	resolution  int
 	persistence int
 }
 
+// createStorageSchema reads the override file, if any, and allowlists the internal hadrianus metrics
+func createStorageSchema(filename string) map[string]overrideData {
+	storageSchema := make(map[string]overrideData)
+	if len(filename) > 0 {
+		storageSchema = getStorageSchemaFromFile(filename)
+	}
+	internalHadrianusPattern, _ := regexp.Compile(`^server\.hadrianus\.`)
+	storageSchema[`hadrianus`] = overrideData{pattern: internalHadrianusPattern, allowUnmodifiedActive: true, allowUnmodified: true}
+	return storageSchema
+}
+
 func getStorageSchemaFromFile(filename string) map[string]overrideData {
 	text := getFileLineData(filename)
 	iniData := getFieldsFromLineData(text)
@@ -61,13 +85,28 @@ func extractStorageSchemaFields(iniData map[string]map[string]string) map[string
 	for section, sectionData := range iniData {
 		var currentRetentionItem overrideData
 
-		// Verify that pattern exists and compile in struct
-		if patternText, ok := sectionData["pattern"]; ok {
-			currentRetentionItem.pattern = regexp.MustCompile(patternText)
-		} else {
-			log.Println(`Missing key "pattern" in section "` + section + `"`)
+		// Verify that pattern, tags or clientsubject exists and compile in struct
+		patternText, patternFound := sectionData["pattern"]
+		tagsText, tagsFound := sectionData["tags"]
+		clientSubjectText, clientSubjectFound := sectionData["clientsubject"]
+		if !patternFound && !tagsFound && !clientSubjectFound {
+			log.Println(`Missing key "pattern", "tags" or "clientsubject" in section "` + section + `"`)
 			os.Exit(1)
 		}
+		if patternFound {
+			currentRetentionItem.pattern = regexp.MustCompile(patternText)
+		}
+		if clientSubjectFound {
+			currentRetentionItem.clientSubject = regexp.MustCompile(clientSubjectText)
+		}
+		if tagsFound {
+			tagExpressions, err := parseTagExpressions(tagsText)
+			if err != nil || len(tagExpressions) == 0 {
+				log.Println(`Invalid value for "tags" in section "` + section + `"`)
+				os.Exit(1)
+			}
+			currentRetentionItem.tags = tagExpressions
+		}
 
 		// Verify that retentions exists and store them in struct
 		if retentionText, ok := sectionData["retentions"]; ok {
@@ -127,7 +166,7 @@ func extractStorageSchemaFields(iniData map[string]map[string]string) map[string
 func getFieldsFromLineData(text []string) map[string]map[string]string {
 	// INI file patterns
 	sectionPattern := regexp.MustCompile(`^\s*\[+\s*([^\]\n]+?)\s*\]+\s*(?:[;#].*)?$`)
-	keyPattern := regexp.MustCompile(`^\s*(\S+)[^\S\n]*=[^\S\n]*([^;#\s](?:[^;#\n]|[;#])*)[^\S\n]*(?:[;#].*)?$`)
+	keyPattern := regexp.MustCompile(`^\s*([^\s=]+)[^\S\n]*=[^\S\n]*([^;#\s](?:[^;#\n]|[;#])*)[^\S\n]*(?:[;#].*)?$`)
 	irrelevantDataPattern := regexp.MustCompile(`^[^\S\n]*[#;].*|^\s*$`)
 
 	var iniData = map[string]map[string]string{}
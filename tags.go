@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// NameTag is the pseudo tag that graphite uses for the name part of a tagged series
+const NameTag = "name"
+
+// Characters that are replaced with underscores in the parts of paths generated from other protocols, like Telegraf's graphite serializer does
+var pathComponentDisallowedCharacters = regexp.MustCompile(`[^a-zA-Z0-9_\-.:]`)
+
+type tagExpression struct {
+	tag     string
+	value   string
+	pattern *regexp.Regexp // Set for the =~ and !=~ operators
+	negated bool
+}
+
+// normalizeMetricPath turns a graphite 1.1 tagged series, like "cpu.load;host=a;dc=x", into its canonical
+// form with the tags sorted. Later duplicates of a tag override earlier ones, just like in graphite.
+// Untagged metric paths are returned as they are.
+func normalizeMetricPath(metricPath string) (string, error) {
+	if !strings.Contains(metricPath, ";") {
+		return metricPath, nil
+	}
+	name, tags, err := parseSeriesTags(metricPath)
+	if err != nil {
+		return metricPath, err
+	}
+	return appendGraphiteTags(name, tags), nil
+}
+
+// appendGraphiteTags appends tags to a metric path in the same order as graphite's TaggedSeries.format, which sorts
+// the formatted ";tag=value" strings rather than the tag names, so that "host2" comes before "host". Like in graphite,
+// a tag called name is dropped, since the name of a series is the part before the tags.
+func appendGraphiteTags(metricPath string, tags map[string]string) string {
+	formattedTags := make([]string, 0, len(tags))
+	for tagName, value := range tags {
+		if tagName != NameTag {
+			formattedTags = append(formattedTags, ";"+tagName+"="+value)
+		}
+	}
+	sort.Strings(formattedTags)
+	return metricPath + strings.Join(formattedTags, "")
+}
+
+func sanitizePathComponent(name string) string {
+	return pathComponentDisallowedCharacters.ReplaceAllString(name, "_")
+}
+
+// removeEmptyPathComponents removes the empty components that templates leave behind for missing values
+func removeEmptyPathComponents(metricPath string) string {
+	var components []string
+	for _, component := range strings.Split(metricPath, ".") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+	return strings.Join(components, ".")
+}
+
+// parseSeriesTags splits a tagged series into its name and tags
+func parseSeriesTags(metricPath string) (string, map[string]string, error) {
+	fields := strings.Split(metricPath, ";")
+	if len(fields[0]) < 1 {
+		return "", nil, errors.New("Missing name in tagged series: " + metricPath)
+	}
+	tags := make(map[string]string, len(fields)-1)
+	for _, field := range fields[1:] {
+		keyValue := strings.SplitN(field, "=", 2)
+		if len(keyValue) != 2 || len(keyValue[0]) < 1 || strings.ContainsAny(keyValue[0], "!^") {
+			return "", nil, errors.New("Invalid tag in tagged series: " + metricPath)
+		}
+		if len(keyValue[1]) < 1 || keyValue[1][0] == '~' {
+			return "", nil, errors.New("Invalid tag value in tagged series: " + metricPath)
+		}
+		tags[keyValue[0]] = keyValue[1]
+	}
+	return fields[0], tags, nil
+}
+
+// parseTagExpressions parses whitespace or comma separated tag expressions using the
+// same operators as graphite's seriesByTag: tag=value, tag!=value, tag=~regex and tag!=~regex
+func parseTagExpressions(text string) ([]tagExpression, error) {
+	var expressions []tagExpression
+	for _, expressionText := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		operatorIndex := strings.Index(expressionText, "=")
+		if operatorIndex < 1 {
+			return nil, errors.New("Invalid tag expression: \"" + expressionText + "\"")
+		}
+		var expression tagExpression
+		expression.tag = expressionText[:operatorIndex]
+		expression.value = expressionText[operatorIndex+1:]
+		if strings.HasSuffix(expression.tag, "!") {
+			expression.negated = true
+			expression.tag = strings.TrimSuffix(expression.tag, "!")
+		}
+		if strings.HasPrefix(expression.value, "~") {
+			// Like graphite, the regular expression is anchored at the beginning of the tag value
+			pattern, err := regexp.Compile(`^(?:` + expression.value[1:] + `)`)
+			if err != nil {
+				return nil, errors.New("Invalid regular expression in tag expression: \"" + expressionText + "\"")
+			}
+			expression.pattern = pattern
+		}
+		if len(expression.tag) < 1 {
+			return nil, errors.New("Invalid tag expression: \"" + expressionText + "\"")
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions, nil
+}
+
+// matchTagExpressions checks that all tag expressions match the tags of a series. A missing tag
+// is treated as an empty value, which is how graphite evaluates seriesByTag expressions.
+func matchTagExpressions(expressions []tagExpression, metricPath string) bool {
+	if len(expressions) == 0 {
+		return true
+	}
+	name := metricPath
+	var tags map[string]string
+	if strings.Contains(metricPath, ";") {
+		var err error
+		if name, tags, err = parseSeriesTags(metricPath); err != nil {
+			return false
+		}
+	}
+
+	for _, expression := range expressions {
+		tagValue := tags[expression.tag]
+		if expression.tag == NameTag {
+			tagValue = name
+		}
+		var matched bool
+		if expression.pattern != nil {
+			matched = expression.pattern.MatchString(tagValue)
+		} else {
+			matched = tagValue == expression.value
+		}
+		if matched == expression.negated {
+			return false
+		}
+	}
+	return true
+}
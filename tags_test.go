@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+)
+
+// The expected paths are what graphite's TaggedSeries.parse and TaggedSeries.format make of the same series
+func TestNormalizeMetricPath(t *testing.T) {
+	tests := []struct {
+		metricPath string
+		expected   string
+	}{
+		{"cpu.load", "cpu.load"},
+		{"cpu.load;host=a", "cpu.load;host=a"},
+		{"cpu.load;host=a;dc=x", "cpu.load;dc=x;host=a"},
+		{"x;host=a;host2=b", "x;host2=b;host=a"},
+		{"x;a=b;A=c", "x;A=c;a=b"},
+		{"x;a.b=1;a=2", "x;a.b=1;a=2"},
+		{"x;host=a;host=b", "x;host=b"},
+		{"x;name=y;a=b", "x;a=b"},
+		{"x;a=b=c", "x;a=b=c"},
+		{"x;a=b~", "x;a=b~"},
+	}
+	for _, test := range tests {
+		if metricPath, err := normalizeMetricPath(test.metricPath); err != nil || metricPath != test.expected {
+			t.Errorf("%s: got %s and error %v, expected %s", test.metricPath, metricPath, err, test.expected)
+		}
+	}
+}
+
+func TestNormalizeMetricPathErrors(t *testing.T) {
+	tests := []string{
+		";a=b",
+		"x;a",
+		"x;=b",
+		"x;a=",
+		"x;a=~b",
+		"x;a!=b",
+		"x;a^b=c",
+		"x;a=b;",
+	}
+	for _, test := range tests {
+		if metricPath, err := normalizeMetricPath(test); err == nil {
+			t.Errorf("%s: got %s, expected an error", test, metricPath)
+		}
+	}
+}
+
+func TestAppendGraphiteTags(t *testing.T) {
+	tests := []struct {
+		metricPath string
+		tags       map[string]string
+		expected   string
+	}{
+		{"x", nil, "x"},
+		{"x", map[string]string{"host": "a", "host2": "b"}, "x;host2=b;host=a"},
+		{"x", map[string]string{"b": "1", "a": "2", NameTag: "y"}, "x;a=2;b=1"},
+	}
+	for _, test := range tests {
+		if metricPath := appendGraphiteTags(test.metricPath, test.tags); metricPath != test.expected {
+			t.Errorf("%s with %v: got %s, expected %s", test.metricPath, test.tags, metricPath, test.expected)
+		}
+	}
+}
+
+func TestPathComponents(t *testing.T) {
+	if component := sanitizePathComponent("web 01/eth0:rx-bytes_total.é"); component != "web_01_eth0:rx-bytes_total._" {
+		t.Errorf("got sanitized component %s", component)
+	}
+	if metricPath := removeEmptyPathComponents(".a..b.c."); metricPath != "a.b.c" {
+		t.Errorf("got path %s without empty components, expected a.b.c", metricPath)
+	}
+}
+
+func TestMatchTagExpressions(t *testing.T) {
+	tests := []struct {
+		expressions string
+		metricPath  string
+		expected    bool
+	}{
+		{"", "x;dc=eu", true},
+		{"dc=eu", "x;dc=eu;host=a", true},
+		{"dc=eu", "x;dc=us", false},
+		{"dc=eu", "x", false},
+		{"dc!=eu", "x", true},
+		{"dc!=eu", "x;dc=eu", false},
+		{"dc=", "x;host=a", true},
+		{"dc=~e", "x;dc=eu", true},
+		{"dc=~u", "x;dc=eu", false},
+		{"dc=~(eu|us)$", "x;dc=us", true},
+		{"dc!=~eu", "x;dc=us", true},
+		{"name=x", "x;dc=eu", true},
+		{"name=~cpu\\.", "cpu.load", true},
+		{"dc=eu host=a", "x;dc=eu;host=a", true},
+		{"dc=eu,host=b", "x;dc=eu;host=a", false},
+		{"dc=eu", "x;dc", false},
+	}
+	for _, test := range tests {
+		expressions, err := parseTagExpressions(test.expressions)
+		if err != nil {
+			t.Errorf("%q: %v", test.expressions, err)
+			continue
+		}
+		if matched := matchTagExpressions(expressions, test.metricPath); matched != test.expected {
+			t.Errorf("%q on %s: got %t, expected %t", test.expressions, test.metricPath, matched, test.expected)
+		}
+	}
+}
+
+func TestParseTagExpressionsErrors(t *testing.T) {
+	tests := []string{
+		"dc",
+		"=eu",
+		"!=eu",
+		"dc=~(eu",
+	}
+	for _, test := range tests {
+		if _, err := parseTagExpressions(test); err == nil {
+			t.Errorf("%q: expected an error", test)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// Client certificate verification modes for the TLS listener
+const (
+	TlsClientAuthNone    = "none"
+	TlsClientAuthRequest = "request"
+	TlsClientAuthRequire = "require"
+)
+
+// createListenerTlsConfig builds the server side TLS configuration from the tls* flags
+func createListenerTlsConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(*tlsCertFile, *tlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch *tlsClientAuth {
+	case TlsClientAuthNone:
+		tlsConfig.ClientAuth = tls.NoClientCert
+	case TlsClientAuthRequest:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case TlsClientAuthRequire:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.New("Invalid value for -tlsclientauth: \"" + *tlsClientAuth + "\"")
+	}
+
+	if *tlsCaFile != "" {
+		if tlsConfig.ClientCAs, err = loadCertificatePool(*tlsCaFile); err != nil {
+			return nil, err
+		}
+	} else if tlsConfig.ClientAuth != tls.NoClientCert {
+		return nil, errors.New("-tlsca is needed to verify client certificates")
+	}
+	return tlsConfig, nil
+}
+
+func loadCertificatePool(filename string) (*x509.CertPool, error) {
+	pemData, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	certificatePool := x509.NewCertPool()
+	if !certificatePool.AppendCertsFromPEM(pemData) {
+		return nil, errors.New("No certificates found in \"" + filename + "\"")
+	}
+	return certificatePool, nil
+}
+
+// connectionClientIdentity reads the PROXY protocol header and completes the TLS handshake, if any, and returns the
+// subject of the verified client certificate. Plain connections and TLS connections without a client certificate have no identity.
+func connectionClientIdentity(connection net.Conn) (string, error) {
+	if err := readProxyProtocolHeader(connection); err != nil {
+		return "", err
+	}
+	tlsConnection, ok := connection.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConnection.Handshake(); err != nil {
+		counterData[TlsHandshakeError]++
+		return "", err
+	}
+	peerCertificates := tlsConnection.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return "", nil
+	}
+	return peerCertificates[0].Subject.String(), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+)
+
+// Ways of handling NaN, +Inf and -Inf values
+const (
+	NonFiniteValuesReject = "reject"
+	NonFiniteValuesAccept = "accept"
+)
+
+// invalidMessageError carries the counter for the reason a message was rejected
+type invalidMessageError struct {
+	reason  CounterId
+	message string
+}
+
+func (err invalidMessageError) Error() string {
+	return err.message
+}
+
+// Matches characters that aren't allowed in metric paths, or nil if all characters are allowed
+var disallowedPathCharacters *regexp.Regexp
+
+func initializeValidationPolicy() error {
+	if *nonFiniteValues != NonFiniteValuesReject && *nonFiniteValues != NonFiniteValuesAccept {
+		return errors.New("Invalid value for -nonfinitevalues: " + *nonFiniteValues)
+	}
+	if *pathCharacters != "" {
+		pattern, err := regexp.Compile(`[^` + *pathCharacters + `]`)
+		if err != nil {
+			return errors.New("Invalid character class for -pathcharacters: " + *pathCharacters)
+		}
+		disallowedPathCharacters = pattern
+	}
+	return nil
+}
+
+// validateMetricMessage applies the checks that are shared by all protocols that send graphite metric paths
+func validateMetricMessage(message metricMessage, description string) error {
+	if disallowedPathCharacters != nil && disallowedPathCharacters.MatchString(message.metricPath) {
+		return invalidMessageError{InvalidMessagePathCharacter, "Disallowed character in metric_path in " + description}
+	}
+	if *nonFiniteValues == NonFiniteValuesReject && (math.IsNaN(message.value) || math.IsInf(message.value, 0)) {
+		return invalidMessageError{InvalidMessageNonFiniteValue, "Non-finite value in " + description}
+	}
+	return nil
+}
+
+// countInvalidMessage counts a rejected message, both in total and by the reason it was rejected for,
+// and returns the reason
+func countInvalidMessage(err error) CounterId {
+	counterData[InvalidMessage]++
+	var invalidMessage invalidMessageError
+	if errors.As(err, &invalidMessage) {
+		counterData[invalidMessage.reason]++
+		return invalidMessage.reason
+	}
+	return InvalidMessage
+}
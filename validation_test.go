@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseGraphiteMessageRejections(t *testing.T) {
+	defer func(characters string) {
+		*pathCharacters = characters
+		disallowedPathCharacters = nil
+	}(*pathCharacters)
+	*pathCharacters = `a-zA-Z0-9_.;=-`
+	if err := initializeValidationPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		message string
+		reason  CounterId
+	}{
+		{"a.b 1", InvalidMessageFieldCount},
+		{"a.b 1 1700000000 x", InvalidMessageFieldCount},
+		{"a.b  1 1700000000", InvalidMessageFieldCount},
+		{" 1 1700000000", InvalidMessageEmptyPath},
+		{"a.b;tag 1 1700000000", InvalidMessageTags},
+		{"a.b;tag=~x 1 1700000000", InvalidMessageTags},
+		{"a.b x 1700000000", InvalidMessageValue},
+		{"a.b 1 x", InvalidMessageTimestamp},
+		{"a.b 1 1700000000.5", InvalidMessageTimestamp},
+		{"a.b NaN 1700000000", InvalidMessageNonFiniteValue},
+		{"a.b +Inf 1700000000", InvalidMessageNonFiniteValue},
+		{"a.b -Inf 1700000000", InvalidMessageNonFiniteValue},
+		{"a/b 1 1700000000", InvalidMessagePathCharacter},
+		{"a.b;tag=x:y 1 1700000000", InvalidMessagePathCharacter},
+	}
+	for _, test := range tests {
+		_, err := parseGraphiteMessage(test.message)
+		var invalidMessage invalidMessageError
+		if !errors.As(err, &invalidMessage) || invalidMessage.reason != test.reason {
+			t.Errorf("%q: got error %v, expected reason %s", test.message, err, counterNames[test.reason])
+		}
+	}
+
+	if message, err := parseGraphiteMessage("a.b;tag=x 1 1700000000"); err != nil || message.metricPath != "a.b;tag=x" {
+		t.Errorf("got %v and error %v for a valid message", message, err)
+	}
+}
+
+func TestValidateMetricMessage(t *testing.T) {
+	defer func(nonFinite string, characters string) {
+		*nonFiniteValues = nonFinite
+		*pathCharacters = characters
+		disallowedPathCharacters = nil
+	}(*nonFiniteValues, *pathCharacters)
+	tests := []struct {
+		name          string
+		nonFinite     string
+		characters    string
+		message       metricMessage
+		reason        CounterId
+		isError       bool
+		isPolicyError bool
+	}{
+		{"all characters allowed", NonFiniteValuesReject, "", metricMessage{metricPath: "a b/ü", value: 1}, 0, false, false},
+		{"allowed characters", NonFiniteValuesReject, "a-z.", metricMessage{metricPath: "a.b", value: 1}, 0, false, false},
+		{"disallowed character", NonFiniteValuesReject, "a-z.", metricMessage{metricPath: "a.B", value: 1}, InvalidMessagePathCharacter, true, false},
+		{"NaN rejected", NonFiniteValuesReject, "", metricMessage{metricPath: "a", value: math.NaN()}, InvalidMessageNonFiniteValue, true, false},
+		{"infinity rejected", NonFiniteValuesReject, "", metricMessage{metricPath: "a", value: math.Inf(-1)}, InvalidMessageNonFiniteValue, true, false},
+		{"NaN accepted", NonFiniteValuesAccept, "", metricMessage{metricPath: "a", value: math.NaN()}, 0, false, false},
+		{"path checked before value", NonFiniteValuesReject, "a", metricMessage{metricPath: "b", value: math.NaN()}, InvalidMessagePathCharacter, true, false},
+		{"invalid nonfinitevalues", "drop", "", metricMessage{}, 0, false, true},
+		{"invalid pathcharacters", NonFiniteValuesReject, "[:foo:]", metricMessage{}, 0, false, true},
+	}
+	for _, test := range tests {
+		*nonFiniteValues = test.nonFinite
+		*pathCharacters = test.characters
+		disallowedPathCharacters = nil
+		if err := initializeValidationPolicy(); (err != nil) != test.isPolicyError {
+			t.Errorf("%s: got policy error %v", test.name, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		err := validateMetricMessage(test.message, "test")
+		if (err != nil) != test.isError {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		invalidBefore, reasonBefore := counterData[InvalidMessage], counterData[test.reason]
+		if reason := countInvalidMessage(err); reason != test.reason || counterData[InvalidMessage] != invalidBefore+1 || counterData[test.reason] != reasonBefore+1 {
+			t.Errorf("%s: got reason %s, expected %s to be counted", test.name, counterNames[reason], counterNames[test.reason])
+		}
+	}
+}
+
+// Errors that don't carry a reason are only counted in total
+func TestCountInvalidMessageWithoutReason(t *testing.T) {
+	invalidBefore := counterData[InvalidMessage]
+	if reason := countInvalidMessage(errors.New("Invalid")); reason != InvalidMessage || counterData[InvalidMessage] != invalidBefore+1 {
+		t.Errorf("got reason %s", counterNames[reason])
+	}
+}